@@ -0,0 +1,93 @@
+package anomalyzer
+
+// The debounced alert state of an anomalyzer, as reported by State.
+type AlertState int
+
+const (
+	StateNormal AlertState = iota
+	StateAnomalous
+)
+
+func (s AlertState) String() string {
+	if s == StateAnomalous {
+		return "anomalous"
+	}
+	return "normal"
+}
+
+// A probability that made the state anomalous, and the value pushed with it.
+type alert struct {
+	prob, value float64
+}
+
+// Return the alert state as of the most recent push.  The state becomes
+// anomalous once MinConsecutive pushes in a row yield a probability of at
+// least Threshold, and only returns to normal once a push yields a
+// probability below ExitThreshold.
+func (a *Anomalyzer) State() AlertState {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if a.alerting {
+		return StateAnomalous
+	}
+	return StateNormal
+}
+
+// Register a handler to be called whenever a pushed value makes the state
+// anomalous, which by default is when the probability crosses
+// Conf.Threshold going upward.  The handler is called once per transition
+// rather than for every point while the state stays anomalous, and is
+// called after the anomalyzer has been unlocked, so it may safely use the
+// anomalyzer.  A nil handler disables the notifications.
+func (a *Anomalyzer) SetAnomalyHandler(handler func(prob, value float64)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.onAnomaly = handler
+}
+
+// Advance the alert state with the probability from a push, appending an
+// alert for the value if the state has just become anomalous.  Expects the
+// caller to hold the lock.
+func (a *Anomalyzer) observe(alerts []alert, prob, value float64) []alert {
+	if a.alerting {
+		if prob < a.Conf.ExitThreshold {
+			a.alerting = false
+			a.streak = 0
+		}
+		return alerts
+	}
+
+	if prob >= a.Conf.Threshold {
+		a.streak++
+	} else {
+		a.streak = 0
+	}
+	if a.streak >= a.Conf.MinConsecutive {
+		a.alerting = true
+		if a.onAnomaly != nil {
+			alerts = append(alerts, alert{prob, value})
+		}
+	}
+	return alerts
+}
+
+// Call the anomaly handler for each of the alerts.  Expects the caller not
+// to hold the lock.
+func (a *Anomalyzer) notify(alerts []alert) {
+	if len(alerts) == 0 {
+		return
+	}
+
+	a.mu.RLock()
+	handler := a.onAnomaly
+	a.mu.RUnlock()
+
+	if handler == nil {
+		return
+	}
+	for _, alert := range alerts {
+		handler(alert.prob, alert.value)
+	}
+}
@@ -4,22 +4,84 @@ import (
 	"fmt"
 	"github.com/drewlanenga/govector"
 	"math"
+	"math/rand"
+	"runtime"
+	"sort"
+	"sync"
 )
 
 type Algorithm func(govector.Vector, AnomalyzerConf) float64
 
+// A Method is a custom detection method that can be registered with
+// RegisterMethod and then referenced by name in AnomalyzerConf.Methods.
+// Run is handed the active and reference windows and should return the
+// probability, between 0 and 1, that the active window is anomalous.
+// Anomalyzers only run their methods once both windows are full.
+type Method interface {
+	Name() string
+	Run(active, reference govector.Vector, conf *AnomalyzerConf) float64
+}
+
 var (
+	// guards Algorithms against registration while anomalyzers are evaluating
+	algorithmsMu sync.RWMutex
+
 	Algorithms = map[string]Algorithm{
-		"magnitude": MagnitudeTest,
-		"diff":      DiffTest,
-		"highrank":  RankTest,
-		"lowrank":   ReverseRankTest,
-		"cdf":       CDFTest,
-		"fence":     FenceTest,
-		"ks":        BootstrapKsTest,
+		"magnitude":   MagnitudeTest,
+		"diff":        DiffTest,
+		"highrank":    RankTest,
+		"lowrank":     ReverseRankTest,
+		"cdf":         CDFTest,
+		"fence":       FenceTest,
+		"ks":          BootstrapKsTest,
+		"ewma":        EwmaTest,
+		"trend":       TrendTest,
+		"robustfence": RobustFenceTest,
+		"cusum":       CusumTest,
+		"ranksum":     RankSumTest,
+		"spike":       SpikeTest,
+		"quantile":    QuantileTest,
+		"levelshift":  LevelShiftTest,
 	}
 )
 
+// Make a custom detection method available under its name.  An error is
+// returned if the name is empty or already taken by another method.
+func RegisterMethod(m Method) error {
+	name := m.Name()
+	if name == "" {
+		return fmt.Errorf("Detection method must have a name")
+	}
+
+	algorithmsMu.Lock()
+	defer algorithmsMu.Unlock()
+
+	if _, ok := Algorithms[name]; ok {
+		return fmt.Errorf("Detection method '%s' is already registered", name)
+	}
+
+	Algorithms[name] = func(vector govector.Vector, conf AnomalyzerConf) float64 {
+		if !allFinite(vector) {
+			return NA
+		}
+		reference, active, err := extractWindows(vector, conf.referenceSize, conf.ActiveSize, 1)
+		if err != nil {
+			return NA
+		}
+		return m.Run(active, reference, &conf)
+	}
+	return nil
+}
+
+// Look up the algorithm registered under the given name.
+func lookupAlgorithm(name string) (Algorithm, bool) {
+	algorithmsMu.RLock()
+	defer algorithmsMu.RUnlock()
+
+	algorithm, ok := Algorithms[name]
+	return algorithm, ok
+}
+
 // Identity function
 func identity(anything interface{}) interface{} {
 	return anything
@@ -35,6 +97,34 @@ func constant(x float64) float64 {
 	return 0.2
 }
 
+// Reports whether every element of the vector is a finite number.  The
+// tests refuse to run over NaN or infinite values rather than return a
+// meaningless probability.
+func allFinite(vector govector.Vector) bool {
+	for _, x := range vector {
+		if math.IsNaN(x) || math.IsInf(x, 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// Reports whether the evaluation using conf has been cancelled through the
+// context passed to EvalContext.  The permutation tests check this between
+// permutations and give up early.
+func cancelled(conf AnomalyzerConf) bool {
+	if conf.ctx == nil {
+		return false
+	}
+
+	select {
+	case <-conf.ctx.Done():
+		return true
+	default:
+		return false
+	}
+}
+
 // Return integer math comparisons
 func max(x, y int) int {
 	if x > y {
@@ -71,10 +161,23 @@ func extractWindows(vector govector.Vector, refSize, activeSize, minRefSize int)
 // This function can be used to test whether or not data is getting close to a
 // specified upper or lower bound.
 func FenceTest(vector govector.Vector, conf AnomalyzerConf) float64 {
+	if conf.stats == nil && !allFinite(vector) {
+		return NA
+	}
+
 	// we don't really care about a reference window for this one
 	_, active, _ := extractWindows(vector, conf.referenceSize, conf.ActiveSize, -1)
 
-	x := active.Mean()
+	var x float64
+	switch {
+	case conf.ForgetFactor > 0:
+		_, active, _, weights := forgetWindows(vector, conf)
+		x, _ = active.WeightedMean(weights)
+	case conf.stats != nil:
+		x = conf.stats.active.mean
+	default:
+		x = active.Mean()
+	}
 
 	distance := 0.0
 	if conf.LowerBound == NA {
@@ -92,6 +195,183 @@ func FenceTest(vector govector.Vector, conf AnomalyzerConf) float64 {
 	return weightExp(cap(distance, 0, 1), 10)
 }
 
+// Like FenceTest, but rather than using fixed bounds, the fences are derived
+// from the reference window as its median plus or minus 3 scaled median
+// absolute deviations.  Unlike the mean and standard deviation, the median
+// and MAD are barely moved by a few extreme points in the reference window.
+func RobustFenceTest(vector govector.Vector, conf AnomalyzerConf) float64 {
+	if !allFinite(vector) {
+		return NA
+	}
+
+	reference, active, err := extractWindows(vector, conf.referenceSize, conf.ActiveSize, 1)
+	if err != nil {
+		return NA
+	}
+
+	center := median(reference)
+	spread := mad(reference, center)
+	return fenceDistance(active.Mean(), center, spread)
+}
+
+// Score how close x is to the fences placed 3 spreads either side of center,
+// scaled in the same way as FenceTest.
+func fenceDistance(x, center, spread float64) float64 {
+	if spread == 0 {
+		if x == center {
+			return 0
+		}
+		return 1
+	}
+
+	distance := math.Abs(x-center) / (3 * spread)
+	return weightExp(cap(distance, 0, 1), 10)
+}
+
+// Scores the single point of the active window that deviates most from the
+// reference window, rather than the window's mean, so that a lone extreme
+// point is not averaged away.  Deviations are measured from the reference
+// median in units of its scaled median absolute deviation, and scaled in
+// the same way as RobustFenceTest.  So that a level raised across the whole
+// active window does not count as a spike, each point must also deviate
+// from the median of the active window, although active windows of fewer
+// than 3 points are too short for that comparison.
+func SpikeTest(vector govector.Vector, conf AnomalyzerConf) float64 {
+	if !allFinite(vector) {
+		return NA
+	}
+
+	reference, active, err := extractWindows(vector, conf.referenceSize, conf.ActiveSize, 1)
+	if err != nil {
+		return NA
+	}
+
+	refCenter := median(reference)
+	spread := mad(reference, refCenter)
+	activeCenter := median(active)
+
+	prob := 0.0
+	for _, x := range active {
+		deviation := math.Abs(x - refCenter)
+		if len(active) >= 3 {
+			deviation = math.Min(deviation, math.Abs(x-activeCenter))
+		}
+		prob = math.Max(prob, fenceDistance(deviation, 0, spread))
+	}
+	return prob
+}
+
+// Bounds the reference window by its LowerQuantile and UpperQuantile
+// percentiles and scores how far the points of the active window fall
+// outside them.  A point beyond a bound is measured against the distance
+// from the reference median to that bound, so that the long tail of a skewed
+// distribution is judged on its own scale, and a point as far again beyond
+// the bound as the bound is from the median scores 1.  The probability
+// returned is the mean of the scores of the active points.
+func QuantileTest(vector govector.Vector, conf AnomalyzerConf) float64 {
+	if !allFinite(vector) {
+		return NA
+	}
+
+	reference, active, err := extractWindows(vector, conf.referenceSize, conf.ActiveSize, 1)
+	if err != nil {
+		return NA
+	}
+
+	sorted := make([]float64, len(reference))
+	copy(sorted, reference)
+	sort.Float64s(sorted)
+	lower := quantile(sorted, conf.LowerQuantile)
+	upper := quantile(sorted, conf.UpperQuantile)
+	center := quantile(sorted, 0.5)
+
+	score := func(excess, scale float64) float64 {
+		if scale == 0 {
+			return 1
+		}
+		return cap(excess/scale, 0, 1)
+	}
+
+	total := 0.0
+	for _, x := range active {
+		switch {
+		case x > upper:
+			total += score(x-upper, upper-center)
+		case x < lower:
+			total += score(lower-x, center-lower)
+		}
+	}
+	return total / float64(len(active))
+}
+
+// Splits the reference and active windows, taken together, into an earlier
+// and a later half and tests whether the series has stepped to a new level
+// between them.  The difference of the means of the halves is divided by its
+// standard error, as in Welch's t-test, and the probability returned is one
+// minus the two-sided p-value under the normal approximation.  Unlike
+// SpikeTest, the probability stays high for as long as the step lies well
+// within the windows, while a lone extreme point inflates the variance of
+// its half along with its mean, and so on its own yields a t statistic of
+// no more than about 1.
+func LevelShiftTest(vector govector.Vector, conf AnomalyzerConf) float64 {
+	if !allFinite(vector) {
+		return NA
+	}
+
+	reference, active, err := extractWindows(vector, conf.referenceSize, conf.ActiveSize, 1)
+	if err != nil {
+		return NA
+	}
+
+	window := vector[len(vector)-len(reference)-len(active):]
+	before, after := window[:len(window)/2], window[len(window)/2:]
+
+	distance := math.Abs(after.Mean() - before.Mean())
+	sdBefore, sdAfter := before.Sd(), after.Sd()
+	se := math.Sqrt(sdBefore*sdBefore/float64(len(before)) + sdAfter*sdAfter/float64(len(after)))
+	if se == 0 {
+		if distance == 0 {
+			return 0
+		}
+		return 1
+	}
+	return math.Erf(distance / se / math.Sqrt2)
+}
+
+// Return the p-th quantile of the sorted values, interpolating linearly
+// between the closest ranks.
+func quantile(sorted []float64, p float64) float64 {
+	h := p * float64(len(sorted)-1)
+	i := int(h)
+	if i+1 >= len(sorted) {
+		return sorted[len(sorted)-1]
+	}
+	return sorted[i] + (h-float64(i))*(sorted[i+1]-sorted[i])
+}
+
+// Return the median of the vector.
+func median(vector govector.Vector) float64 {
+	sorted := make([]float64, len(vector))
+	copy(sorted, vector)
+	sort.Float64s(sorted)
+
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// Return the median absolute deviation of the vector around center, scaled
+// so that it estimates the standard deviation of normally distributed data.
+func mad(vector govector.Vector, center float64) float64 {
+	deviations := make(govector.Vector, len(vector))
+	for i, x := range vector {
+		deviations[i] = math.Abs(x - center)
+	}
+	return 1.4826 * median(deviations)
+}
+
 // This is a function will sharply scale values between 0 and 1 such that
 // smaller values are weighted more towards 0. A larger base value means a
 // more horshoe type function.
@@ -103,8 +383,13 @@ func weightExp(x, base float64) float64 {
 // whether or not data is anomalous. The number of permutations desired has
 // been set to 500 but can be increased for more precision.
 func DiffTest(vector govector.Vector, conf AnomalyzerConf) float64 {
+	if !allFinite(vector) {
+		return NA
+	}
+
 	// Find the differences between neighboring elements and rank those differences.
-	ranks := vector.RelDiff().Apply(math.Abs).Rank()
+	buf := conf.permBuffers()
+	ranks := buf.rank(buf.absRelDiff(vector))
 
 	// The indexing runs to length-1 because after applying .Diff(), We have
 	// decreased the length of out vector by 1.
@@ -123,7 +408,11 @@ func DiffTest(vector govector.Vector, conf AnomalyzerConf) float64 {
 	// Permute the active and reference data and compute the sums across the tail
 	// (from the length of the reference data to the full length).
 	for i < conf.PermCount {
-		permRanks := vector.Shuffle().RelDiff().Apply(math.Abs).Rank()
+		if cancelled(conf) {
+			return NA
+		}
+
+		permRanks := buf.rank(buf.absRelDiff(buf.shuffle(vector, conf.rand)))
 		_, permActive, _ := extractWindows(permRanks, conf.referenceSize-1, conf.ActiveSize, conf.ActiveSize)
 
 		// If we find a sum that is less than the initial sum across the active data,
@@ -134,6 +423,8 @@ func DiffTest(vector govector.Vector, conf AnomalyzerConf) float64 {
 		}
 		i++
 	}
+	conf.recordPermutations(conf.PermCount)
+
 	// We return the percentage of the number of iterations where we found our initial
 	// sum to be high.
 	return float64(significant) / float64(conf.PermCount)
@@ -168,8 +459,13 @@ func lessThan(x, y float64) bool {
 // to 500 but can be increased for more precision. A comparison function above
 // can be specified to create Rank and ReverseRank tests.
 func rankTest(vector govector.Vector, conf AnomalyzerConf, comparison compare) float64 {
+	if !allFinite(vector) {
+		return NA
+	}
+
 	// Rank the elements of a vector
-	ranks := vector.Rank()
+	buf := conf.permBuffers()
+	ranks := buf.rank(vector)
 
 	_, active, err := extractWindows(ranks, conf.referenceSize, conf.ActiveSize, conf.ActiveSize)
 	if err != nil {
@@ -186,7 +482,11 @@ func rankTest(vector govector.Vector, conf AnomalyzerConf, comparison compare) f
 	// Permute the active and reference data and compute the sums across the tail
 	// (from the length of the reference data to the full length).
 	for i < conf.PermCount {
-		permRanks := vector.Shuffle().Rank()
+		if cancelled(conf) {
+			return NA
+		}
+
+		permRanks := buf.rank(buf.shuffle(vector, conf.rand))
 		_, permActive, _ := extractWindows(permRanks, conf.referenceSize, conf.ActiveSize, conf.ActiveSize)
 
 		// If we find a sum that is less than the initial sum across the active data,
@@ -199,6 +499,8 @@ func rankTest(vector govector.Vector, conf AnomalyzerConf, comparison compare) f
 		}
 		i++
 	}
+	conf.recordPermutations(conf.PermCount)
+
 	// We return the percentage of the number of iterations where we found our initial
 	// sum to be high.
 	return float64(significant) / float64(conf.PermCount)
@@ -207,17 +509,35 @@ func rankTest(vector govector.Vector, conf AnomalyzerConf, comparison compare) f
 // Generates the cumulative distribution function using the difference in the means
 // for the data.
 func CDFTest(vector govector.Vector, conf AnomalyzerConf) float64 {
+	if !allFinite(vector) {
+		return NA
+	}
+
 	diffs := vector.Diff().Apply(math.Abs)
 	reference, active, err := extractWindows(diffs, conf.referenceSize-1, conf.ActiveSize, conf.ActiveSize)
 	if err != nil {
 		return NA
 	}
 
-	// Find the empircal distribution function using the reference window.
+	// Find the empircal distribution function using the reference window,
+	// and the difference between the active and reference means, weighting
+	// recent reference points more heavily if a half-life is set, or every
+	// point by its age if a forget factor is.
 	refEcdf := reference.Ecdf()
-
-	// Difference between the active and reference means.
-	activeDiff := active.Mean() - reference.Mean()
+	refMean, activeMean := reference.Mean(), active.Mean()
+	switch {
+	case conf.ForgetFactor > 0:
+		var refWeights, activeWeights govector.Vector
+		reference, active, refWeights, activeWeights = forgetWindows(diffs, conf)
+		refEcdf = weightedEcdf(reference, refWeights)
+		refMean, _ = reference.WeightedMean(refWeights)
+		activeMean, _ = active.WeightedMean(activeWeights)
+	case conf.HalfLife > 0:
+		weights := recencyWeights(len(reference), conf.HalfLife)
+		refEcdf = weightedEcdf(reference, weights)
+		refMean, _ = reference.WeightedMean(weights)
+	}
+	activeDiff := activeMean - refMean
 
 	// Apply the empirical distribution function to that difference.
 	percentile := refEcdf(activeDiff)
@@ -226,16 +546,54 @@ func CDFTest(vector govector.Vector, conf AnomalyzerConf) float64 {
 	return (2 * math.Abs(0.5-percentile))
 }
 
+// Return weights for the n points of a reference window that halve every
+// halfLife points back from its most recent point.
+func recencyWeights(n int, halfLife float64) govector.Vector {
+	weights := make(govector.Vector, n)
+	for i := range weights {
+		weights[i] = math.Pow(0.5, float64(n-1-i)/halfLife)
+	}
+	return weights
+}
+
+// Like Ecdf, but each value counts towards the distribution in proportion
+// to its weight.
+func weightedEcdf(vector, weights govector.Vector) func(float64) float64 {
+	total := weights.Sum()
+	return func(x float64) float64 {
+		below := 0.0
+		for i, y := range vector {
+			if y <= x {
+				below += weights[i]
+			}
+		}
+		return below / total
+	}
+}
+
 // Generates the percent difference between the means of the reference and active
 // data. Returns a value scaled such that it lies between 0 and 1.
 func MagnitudeTest(vector govector.Vector, conf AnomalyzerConf) float64 {
+	if conf.stats == nil && !allFinite(vector) {
+		return NA
+	}
+
 	reference, active, err := extractWindows(vector, conf.referenceSize, conf.ActiveSize, 1)
 	if err != nil {
 		return NA
 	}
 
-	activeMean := active.Mean()
-	refMean := reference.Mean()
+	var activeMean, refMean float64
+	switch {
+	case conf.ForgetFactor > 0:
+		reference, active, refWeights, activeWeights := forgetWindows(vector, conf)
+		refMean, _ = reference.WeightedMean(refWeights)
+		activeMean, _ = active.WeightedMean(activeWeights)
+	case conf.stats != nil:
+		activeMean, refMean = conf.stats.active.mean, conf.stats.reference.mean
+	default:
+		activeMean, refMean = active.Mean(), reference.Mean()
+	}
 
 	// If the baseline is 0, then the magnitude should be Inf, but we'll
 	// round to 1.
@@ -247,8 +605,211 @@ func MagnitudeTest(vector govector.Vector, conf AnomalyzerConf) float64 {
 	return pdiff
 }
 
+// Compares the mean of the active window to an exponentially weighted moving
+// average of the reference window, which tracks recent behavior more closely
+// than the full reference mean.  The distance is measured in reference
+// standard deviations and mapped to a probability between 0 and 1.
+func EwmaTest(vector govector.Vector, conf AnomalyzerConf) float64 {
+	if !allFinite(vector) {
+		return NA
+	}
+
+	reference, active, err := extractWindows(vector, conf.referenceSize, conf.ActiveSize, 2)
+	if err != nil {
+		return NA
+	}
+
+	ewma := reference[0]
+	for _, x := range reference[1:] {
+		ewma = conf.EwmaDecay*x + (1-conf.EwmaDecay)*ewma
+	}
+
+	distance := math.Abs(active.Mean() - ewma)
+	sd := reference.Sd()
+	if sd == 0 {
+		// any departure from a perfectly flat reference is anomalous
+		if distance == 0 {
+			return 0
+		}
+		return 1
+	}
+
+	// The probability that a normal deviate lies within distance/sd
+	// standard deviations of the mean.
+	return math.Erf(distance / sd / math.Sqrt2)
+}
+
+// Fits a least-squares line to the active window and compares its slope to
+// the slopes of lines fit to every active-sized run of the reference window.
+// The distance from the typical reference slope is measured in standard
+// deviations of the reference slopes and mapped to a probability between 0
+// and 1.  Active windows of fewer than 3 points are too short to yield a
+// meaningful slope, so the test returns 0 for them.
+func TrendTest(vector govector.Vector, conf AnomalyzerConf) float64 {
+	if conf.ActiveSize < 3 {
+		return 0
+	}
+	if !allFinite(vector) {
+		return NA
+	}
+
+	reference, active, err := extractWindows(vector, conf.referenceSize, conf.ActiveSize, 2*conf.ActiveSize)
+	if err != nil {
+		return NA
+	}
+
+	// the slope of every run of the reference window as long as the
+	// active window
+	refSlopes := make(govector.Vector, 0, len(reference)-conf.ActiveSize+1)
+	for i := 0; i+conf.ActiveSize <= len(reference); i++ {
+		refSlopes = append(refSlopes, slope(reference[i:i+conf.ActiveSize]))
+	}
+
+	distance := math.Abs(slope(active) - refSlopes.Mean())
+	sd := refSlopes.Sd()
+	if sd == 0 {
+		if distance == 0 {
+			return 0
+		}
+		return 1
+	}
+	return math.Erf(distance / sd / math.Sqrt2)
+}
+
+// Return the slope of the least-squares line through the points of the
+// vector, taken to be evenly spaced.
+func slope(vector govector.Vector) float64 {
+	n := float64(len(vector))
+	xMean := (n - 1) / 2
+	yMean := vector.Mean()
+
+	num, den := 0.0, 0.0
+	for i, y := range vector {
+		dx := float64(i) - xMean
+		num += dx * (y - yMean)
+		den += dx * dx
+	}
+	return num / den
+}
+
+// The decision interval of the cusum test, in reference standard deviations,
+// at which the accumulated deviation yields a probability of 1.
+const cusumLimit = 5.0
+
+// Runs a two-sided cumulative sum control chart over the active window,
+// accumulating each point's deviation from the reference mean, in reference
+// standard deviations, less an allowance of CusumSlack.  Small but persistent
+// shifts in the mean build up over the window, while symmetric noise is
+// absorbed by the slack.  The larger of the upper and lower sums at the end of
+// the window is scaled against the decision interval to yield a probability.
+func CusumTest(vector govector.Vector, conf AnomalyzerConf) float64 {
+	if conf.stats == nil && !allFinite(vector) {
+		return NA
+	}
+
+	reference, active, err := extractWindows(vector, conf.referenceSize, conf.ActiveSize, 2)
+	if err != nil {
+		return NA
+	}
+
+	var mean, sd float64
+	if conf.stats != nil {
+		mean, sd = conf.stats.reference.mean, conf.stats.reference.sd()
+	} else {
+		mean, sd = reference.Mean(), reference.Sd()
+	}
+	if sd == 0 {
+		for _, x := range active {
+			if x != mean {
+				return 1
+			}
+		}
+		return 0
+	}
+
+	upper, lower := 0.0, 0.0
+	for _, x := range active {
+		z := (x - mean) / sd
+		upper = math.Max(0, upper+z-conf.CusumSlack)
+		lower = math.Max(0, lower-z-conf.CusumSlack)
+	}
+	return cap(math.Max(upper, lower)/cusumLimit, 0, 1)
+}
+
+// Performs a two-sided Mann-Whitney U test of whether the values of the
+// active window tend to be larger or smaller than those of the reference
+// window.  The U statistic is converted to a z-score using the normal
+// approximation, with the variance corrected for ties, and the probability
+// returned is one minus the two-sided p-value.
+func RankSumTest(vector govector.Vector, conf AnomalyzerConf) float64 {
+	if !allFinite(vector) {
+		return NA
+	}
+
+	reference, active, err := extractWindows(vector, conf.referenceSize, conf.ActiveSize, 1)
+	if err != nil {
+		return NA
+	}
+
+	n1, n2 := float64(len(active)), float64(len(reference))
+	n := n1 + n2
+
+	combined := make(govector.Vector, 0, len(active)+len(reference))
+	combined = append(combined, active...)
+	combined = append(combined, reference...)
+	ranks, ties := midranks(combined)
+
+	// the sum of the ranks of the active window
+	activeSum := ranks[:len(active)].Sum()
+	u := activeSum - n1*(n1+1)/2
+
+	mean := n1 * n2 / 2
+	variance := n1 * n2 / 12 * ((n + 1) - ties/(n*(n-1)))
+	if variance <= 0 {
+		// every value is tied, so nothing distinguishes the windows
+		return 0
+	}
+
+	z := (u - mean) / math.Sqrt(variance)
+	return math.Erf(math.Abs(z) / math.Sqrt2)
+}
+
+// Return the 1-based ranks of the values of the vector, giving tied values
+// the mean of the ranks they span, along with the sum of t^3 - t over each
+// group of t tied values for use in the tie correction.
+func midranks(vector govector.Vector) (govector.Vector, float64) {
+	order := make([]int, len(vector))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return vector[order[i]] < vector[order[j]] })
+
+	ranks := make(govector.Vector, len(vector))
+	ties := 0.0
+	for i := 0; i < len(order); {
+		j := i
+		for j+1 < len(order) && vector[order[j+1]] == vector[order[i]] {
+			j++
+		}
+
+		rank := float64(i+j)/2 + 1
+		for k := i; k <= j; k++ {
+			ranks[order[k]] = rank
+		}
+
+		t := float64(j - i + 1)
+		ties += t*t*t - t
+		i = j + 1
+	}
+	return ranks, ties
+}
+
 // Calculate a Kolmogorov-Smirnov test statistic.
 func KsStat(vector govector.Vector, conf AnomalyzerConf) float64 {
+	return ksStat(vector, conf, conf.permBuffers())
+}
+
+func ksStat(vector govector.Vector, conf AnomalyzerConf, buf *buffers) float64 {
 	reference, active, err := extractWindows(vector, conf.referenceSize, conf.ActiveSize, conf.ActiveSize)
 	if err != nil {
 		return NA
@@ -259,61 +820,343 @@ func KsStat(vector govector.Vector, conf AnomalyzerConf) float64 {
 		return NA
 	}
 
-	// First sort the active data and generate a cummulative distribution function
-	// using that data. Do the same for the reference data.
-	activeEcdf := active.Ecdf()
-	refEcdf := reference.Ecdf()
+	// First sort the active data so that its cummulative distribution
+	// function can be read off as we step through increasing values. Do the
+	// same for the reference data.
+	buf.sorted = grow(buf.sorted, n1+n2)
+	sortedRef, sortedActive := buf.sorted[:n1], buf.sorted[n1:]
+	copy(sortedRef, reference)
+	copy(sortedActive, active)
+	sort.Float64s(sortedRef)
+	sort.Float64s(sortedActive)
 
 	// We want the reference and active vectors to have the same length n, so we
 	// consider the min and max for each and interpolated the points between.
 	min := math.Min(reference.Min(), active.Min())
 	max := math.Max(reference.Max(), active.Max())
+	step := (max - min) / (float64(n1+n2) - 1)
 
-	interpolated := interpolate(min, max, n1+n2)
-
-	// Then we apply the distribution function over the interpolated data.
-	activeDist := interpolated.Apply(activeEcdf)
-	refDist := interpolated.Apply(refEcdf)
-
-	// Find the maximum displacement between both distributions.
+	// Then we apply the distribution functions over the interpolated points
+	// and find the maximum displacement between both distributions.
 	d := 0.0
+	x, i1, i2 := min, 0, 0
 	for i := 0; i < n1+n2; i++ {
-		d = math.Max(d, math.Abs(activeDist[i]-refDist[i]))
+		if i > 0 {
+			x += step
+		}
+		for i1 < n1 && sortedRef[i1] <= x {
+			i1++
+		}
+		for i2 < n2 && sortedActive[i2] <= x {
+			i2++
+		}
+		refDist := float64(i1) / float64(n1)
+		activeDist := float64(i2) / float64(n2)
+		d = math.Max(d, math.Abs(activeDist-refDist))
 	}
 	return d
 }
 
+// Compares the KS statistic of the active and reference windows to the
+// statistics obtained after permuting all elements.  The permutations are
+// split into chunks, each drawing from its own random source, which are
+// spread across up to GOMAXPROCS workers.
+// If ExactKS is set and the windows are small enough, the exact
+// distribution of the statistic is used instead of permutations.
 func BootstrapKsTest(vector govector.Vector, conf AnomalyzerConf) float64 {
-	dist := KsStat(vector, conf)
+	if conf.ExactKS {
+		if prob, ok := exactKsTest(vector, conf); ok {
+			return prob
+		}
+	}
+	return bootstrapKsTest(vector, conf, runtime.GOMAXPROCS(0))
+}
+
+// The largest product of the sizes of the windows for which the exact KS
+// distribution is computed, beyond which the ks test falls back to
+// permutations.
+const exactKsLimit = 10000
+
+// Return the probability that the KS statistic of two samples of the sizes
+// of the windows, drawn from the same continuous distribution, is less than
+// the statistic of the windows.  This is the value the permutations of
+// bootstrapKsTest estimate.  The boolean is false if the windows are too
+// large for the exact distribution to be computed.
+func exactKsTest(vector govector.Vector, conf AnomalyzerConf) (float64, bool) {
+	if !allFinite(vector) {
+		return NA, true
+	}
+
+	reference, active, err := extractWindows(vector, conf.referenceSize, conf.ActiveSize, conf.ActiveSize)
+	if err != nil {
+		return NA, true
+	}
+	if len(active)*len(reference) > exactKsLimit {
+		return 0, false
+	}
+
+	return ksCdf(ksDistance(active, reference), len(active), len(reference)), true
+}
+
+// Return the two-sample KS statistic, the largest difference between the
+// empirical distribution functions of the samples at any of their values.
+func ksDistance(x, y govector.Vector) float64 {
+	xs := append([]float64(nil), x...)
+	ys := append([]float64(nil), y...)
+	sort.Float64s(xs)
+	sort.Float64s(ys)
+
+	d := 0.0
+	i, j := 0, 0
+	for i < len(xs) && j < len(ys) {
+		// step past every value equal to the smallest remaining one
+		v := math.Min(xs[i], ys[j])
+		for i < len(xs) && xs[i] == v {
+			i++
+		}
+		for j < len(ys) && ys[j] == v {
+			j++
+		}
+		d = math.Max(d, math.Abs(float64(i)/float64(len(xs))-float64(j)/float64(len(ys))))
+	}
+	return d
+}
+
+// Return the probability that the KS statistic of samples of sizes m and n
+// from the same continuous distribution is less than d.  Every ordering of
+// the pooled samples is a path through the m by n grid, and the statistic is
+// less than d exactly when the path stays close enough to the diagonal, so
+// the probability is that of a random path doing so.  It is computed row by
+// row, as the probability of reaching each point within the band.
+func ksCdf(d float64, m, n int) float64 {
+	// every difference between the distribution functions is a multiple
+	// of 1/mn, so compare in those units
+	limit := int(math.Round(d * float64(m) * float64(n)))
+	within := func(i, j int) bool {
+		diff := i*n - j*m
+		return diff < limit && -diff < limit
+	}
+
+	u := make([]float64, n+1)
+	for i := 0; i <= m; i++ {
+		for j := 0; j <= n; j++ {
+			switch {
+			case !within(i, j):
+				u[j] = 0
+			case i == 0 && j == 0:
+				u[j] = 1
+			case j == 0:
+				// u[0] still holds the point below
+			default:
+				u[j] = (float64(i)*u[j] + float64(j)*u[j-1]) / float64(i+j)
+			}
+		}
+	}
+	return u[n]
+}
+
+// The number of permutations of the ks test drawn from each random source.
+// The permutations are split into chunks of this size, each seeded in turn
+// from the anomalyzer's source, so that a seeded anomalyzer yields the same
+// result however many workers the chunks are spread across.
+const ksChunkSize = 250
+
+func bootstrapKsTest(vector govector.Vector, conf AnomalyzerConf, workers int) float64 {
+	if !allFinite(vector) {
+		return NA
+	}
+
+	buf := conf.permBuffers()
+	dist := ksStat(vector, conf, buf)
 	if dist == NA {
 		return NA
 	}
 
-	i := 0
+	// Seed every chunk up front, in order, so that the result does not
+	// depend on how the chunks are scheduled.
+	chunks := (conf.PermCount + ksChunkSize - 1) / ksChunkSize
+	buf.seeds = append(buf.seeds[:0], make([]int64, chunks)...)
+	for c := range buf.seeds {
+		buf.seeds[c] = nextSeed(conf.rand)
+	}
+	buf.counts = append(buf.counts[:0], make([]int, chunks)...)
+	chunkSize := func(c int) int {
+		return min(ksChunkSize, conf.PermCount-c*ksChunkSize)
+	}
+
+	workers = min(workers, chunks)
+	if workers <= 1 {
+		for c := range buf.seeds {
+			buf.counts[c] = countKsChunk(vector, conf, buf, dist, buf.seeds[c], chunkSize(c))
+		}
+	} else {
+		if len(buf.workers) < workers {
+			buf.workers = make([]buffers, workers)
+		}
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for c := w; c < chunks; c += workers {
+					buf.counts[c] = countKsChunk(vector, conf, &buf.workers[w], dist, buf.seeds[c], chunkSize(c))
+				}
+			}(w)
+		}
+		wg.Wait()
+	}
+
+	if cancelled(conf) {
+		return NA
+	}
+
 	significant := 0
+	for _, count := range buf.counts {
+		significant += count
+	}
+	conf.recordPermutations(conf.PermCount)
+	return float64(significant) / float64(conf.PermCount)
+}
 
-	for i < conf.PermCount {
-		permVector := vector.Shuffle()
-		permDist := KsStat(permVector, conf)
+// Count how many of n permutations of the vector yield a KS statistic
+// smaller than dist, drawing them from buf's chunk source seeded with seed.
+func countKsChunk(vector govector.Vector, conf AnomalyzerConf, buf *buffers, dist float64, seed int64, n int) int {
+	if buf.chunkRand == nil {
+		buf.chunkRand = rand.New(&buf.chunkSource)
+	}
+	buf.chunkSource.Seed(seed)
+	conf.rand = buf.chunkRand
+
+	significant := 0
+	for i := 0; i < n; i++ {
+		if cancelled(conf) {
+			break
+		}
+
+		permVector := buf.shuffle(vector, conf.rand)
+		permDist := ksStat(permVector, conf, buf)
 
 		if permDist < dist {
 			significant++
 		}
-		i++
 	}
-	return float64(significant) / float64(conf.PermCount)
+	return significant
+}
+
+// Draw a seed for a new random source from rng, or from the global source
+// when rng is nil.
+func nextSeed(rng *rand.Rand) int64 {
+	if rng == nil {
+		return rand.Int63()
+	}
+	return rng.Int63()
 }
 
-// A helper function for KS that rescales a vector to the desired length npoints.
-func interpolate(min, max float64, npoints int) govector.Vector {
-	interp := make(govector.Vector, npoints)
+// Scratch space for the permutation tests, so that they do not allocate
+// fresh vectors for every permutation.  Anomalyzers keep theirs from one
+// push to the next; otherwise each test makes its own for the duration of
+// the call.
+type buffers struct {
+	perm, sorted govector.Vector
+	diffs, ranks govector.Vector
+	order        rankOrder
 
-	step := (max - min) / (float64(npoints) - 1)
-	interp[0] = min
-	i := 1
-	for i < npoints {
-		interp[i] = interp[i-1] + step
-		i++
+	// the seeds and counts of the chunks of the KS test, and the source
+	// each chunk's permutations are drawn from
+	seeds       []int64
+	counts      []int
+	chunkSource splitMix
+	chunkRand   *rand.Rand
+
+	// for the workers of the parallel KS test
+	workers []buffers
+}
+
+// Record that the probability of the method being run was estimated from n
+// permutations, for EvalWithInterval to bound its error.
+func (conf AnomalyzerConf) recordPermutations(n int) {
+	if conf.permutations != nil {
+		*conf.permutations = n
 	}
-	return interp
+}
+
+// Return the buffers of the evaluation in progress, or new ones if there
+// are none.
+func (conf AnomalyzerConf) permBuffers() *buffers {
+	if conf.buffers != nil {
+		return conf.buffers
+	}
+	return &buffers{}
+}
+
+// Return the vector resized to n zeroed values, reallocating only if it is
+// too small.
+func grow(vector govector.Vector, n int) govector.Vector {
+	return append(vector[:0], make(govector.Vector, n)...)
+}
+
+// Return a randomly permuted copy of the vector, which is only valid until
+// the next shuffle.  The permutation is drawn from rng when supplied,
+// otherwise from the global source.
+func (buf *buffers) shuffle(vector govector.Vector, rng *rand.Rand) govector.Vector {
+	buf.perm = grow(buf.perm, len(vector))
+	shuffled := buf.perm
+	copy(shuffled, vector)
+
+	swap := func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	}
+	if rng == nil {
+		rand.Shuffle(len(shuffled), swap)
+	} else {
+		rng.Shuffle(len(shuffled), swap)
+	}
+	return shuffled
+}
+
+// Return the absolute relative differences between neighboring elements of
+// the vector, which are only valid until the next call.
+func (buf *buffers) absRelDiff(vector govector.Vector) govector.Vector {
+	if len(vector) < 2 {
+		return buf.diffs[:0]
+	}
+	buf.diffs = grow(buf.diffs, len(vector)-1)
+	for i := range buf.diffs {
+		buf.diffs[i] = math.Abs(vector[i+1]/vector[i] - 1)
+	}
+	return buf.diffs
+}
+
+// Return the ranks of the elements of the vector counting from 0, with
+// ties ranked in the order they appear, which are only valid until the next
+// call.
+func (buf *buffers) rank(vector govector.Vector) govector.Vector {
+	order := &buf.order
+	order.values = vector
+	order.index = append(order.index[:0], make([]int, len(vector))...)
+	for i := range order.index {
+		order.index[i] = i
+	}
+	sort.Sort(order)
+
+	buf.ranks = grow(buf.ranks, len(vector))
+	for rank, i := range order.index {
+		buf.ranks[i] = float64(rank)
+	}
+	return buf.ranks
+}
+
+// Positions of a vector sorted by their values, for ranking them.
+type rankOrder struct {
+	index  []int
+	values govector.Vector
+}
+
+func (o *rankOrder) Len() int { return len(o.index) }
+
+func (o *rankOrder) Swap(i, j int) { o.index[i], o.index[j] = o.index[j], o.index[i] }
+
+func (o *rankOrder) Less(i, j int) bool {
+	x, y := o.values[o.index[i]], o.values[o.index[j]]
+	return x < y || (x == y && o.index[i] < o.index[j])
 }
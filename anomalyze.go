@@ -1,8 +1,13 @@
 package anomalyzer
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"math"
+	"math/rand"
+	"sync"
+	"time"
 
 	"github.com/drewlanenga/govector"
 )
@@ -11,6 +16,49 @@ const (
 	NA = math.SmallestNonzeroFloat64
 )
 
+// ErrInsufficientData is returned by EvalContext when there are not yet
+// enough points to fill both the active and reference windows, or fewer
+// than Warmup points have been added.
+var ErrInsufficientData = errors.New("Not enough data to fill the active and reference windows")
+
+// The direction of an anomaly, relative to the reference window.
+type Direction int
+
+const (
+	DirectionNone Direction = iota
+	DirectionUp
+	DirectionDown
+)
+
+func (d Direction) String() string {
+	switch d {
+	case DirectionUp:
+		return "up"
+	case DirectionDown:
+		return "down"
+	}
+	return "none"
+}
+
+// The severity of an anomaly, as classified by Classify.
+type Severity int
+
+const (
+	SeverityNone Severity = iota
+	SeverityWarning
+	SeverityCritical
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityWarning:
+		return "warning"
+	case SeverityCritical:
+		return "critical"
+	}
+	return "none"
+}
+
 type AnomalyzerConf struct {
 	Sensitivity   float64
 	UpperBound    float64
@@ -20,22 +68,266 @@ type AnomalyzerConf struct {
 	NSeasons      int
 	PermCount     int
 	Methods       []string
+
+	// ReferenceSize, when set, is the number of points preceding the
+	// active window that make up the reference window.  Otherwise the
+	// reference window is NSeasons times the active window.
+	ReferenceSize int
+
+	// SeasonalReference, when set, assembles the reference window from
+	// the points at the same phase as the active window in each of the
+	// previous NSeasons seasons, rather than from the points immediately
+	// preceding it.  SeasonLength is the number of points in a season,
+	// such as 24 for hourly data with a daily cycle, and must be at least
+	// ActiveSize.
+	SeasonalReference bool
+	SeasonLength      int
+
+	// ExactKS, when set, makes the ks test compute the exact distribution
+	// of the KS statistic rather than estimating it by permutation,
+	// provided the windows are small enough.
+	ExactKS bool
+
+	// EwmaDecay is the weight, between 0 and 1, given to each new point by
+	// the moving average of the ewma test.  Defaults to 0.3.
+	EwmaDecay float64
+
+	// CusumSlack is the allowance, in reference standard deviations, that
+	// each point of the active window may deviate from the reference mean
+	// before the cusum test accumulates it.  Defaults to 0.25, suited to
+	// detecting shifts of around half a standard deviation.
+	CusumSlack float64
+
+	// HalfLife, when positive, weights the points of the reference window
+	// in the cdf test by how recent they are, with the weight halving every
+	// HalfLife points back from the active window.  Otherwise every point
+	// is weighted alike.  Only the cdf test is affected, through the
+	// distribution function and mean of its reference window.  The fence
+	// test compares the active window to fixed bounds and ignores it.
+	HalfLife float64
+
+	// LowerQuantile and UpperQuantile are the percentiles of the reference
+	// window, between 0 and 1, that bound the interval of the quantile
+	// test.  They default to 0.01 and 0.99.
+	LowerQuantile float64
+	UpperQuantile float64
+
+	// Interval, when positive, resamples the series into buckets of this
+	// width using the timestamps given to PushAt before the tests are run.
+	// Points within a bucket are averaged and empty buckets carry forward
+	// the previous value.
+	Interval time.Duration
+
+	// Threshold is the probability at or above which behavior is
+	// considered anomalous.  Defaults to 0.8.
+	Threshold float64
+
+	// Seed, when non-zero, seeds the random source used by the
+	// permutation tests so that results are reproducible.
+	Seed int64
+
+	// the random source, context and scratch space of the evaluation in
+	// progress, and the statistics of its windows when they are kept
+	// running, which only hold for the series being evaluated and not for
+	// permutations of it.  The series is known to be finite when they are
+	// set, since Push rejects non-finite points.  permutations, when set,
+	// is where the method being run records how many permutations it
+	// estimated its probability from.
+	rand         *rand.Rand
+	ctx          context.Context
+	buffers      *buffers
+	stats        *windowStats
+	permutations *int
+
+	// ExitThreshold is the probability below which an anomalous state, as
+	// reported by State, returns to normal.  Setting it below Threshold
+	// stops the state flapping when the probability hovers around the
+	// threshold.  Defaults to Threshold.
+	ExitThreshold float64
+
+	// MinConsecutive is the number of consecutive pushes that must be at
+	// or above Threshold before the state becomes anomalous.  Defaults to 1.
+	MinConsecutive int
+
+	// WarningThreshold and CriticalThreshold are the probabilities at or
+	// above which Classify reports a warning or a critical anomaly.  They
+	// default to 0.8 and 0.95.
+	WarningThreshold  float64
+	CriticalThreshold float64
+
+	// Aggregation selects how the probabilities of the methods are
+	// combined: "weighted" (the default) takes their weighted mean,
+	// "mean" their plain mean and "max" the largest of them.  Whichever
+	// is used, the probability is 0 while the magnitude test is below
+	// Sensitivity.
+	Aggregation string
+
+	// Weights overrides the weight given to each method's probability
+	// when they are combined by weighted aggregation.  Methods without an
+	// entry keep their default weight.
+	Weights map[string]float64
+
+	// NormalizeMethods, when set, scores each method's probability by how
+	// far it lies above that method's recent probabilities before they
+	// are combined, so that a method that is always high does not
+	// dominate the others.
+	NormalizeMethods bool
+
+	// Observer, when set, is told how long each evaluation takes and what
+	// each method returned.  It is not serialized.
+	Observer Observer `json:"-"`
+
+	// Warmup is the number of points that must be added before Eval
+	// reports anything other than 0, to avoid alerting off a short history.
+	Warmup int
+
+	// ForgetFactor, when between 0 and 1, weights every point by
+	// ForgetFactor raised to its age, the number of points it lies back
+	// from the newest, so that old points fade out of the reference window
+	// rather than falling off its edge.  The magnitude, fence and cdf tests
+	// then take every point before the active window, by its weight, as
+	// the reference window, and Push drops points once their weight falls
+	// below 0.01.  The other tests keep their usual windows.
+	ForgetFactor float64
+
+	// MaxDataPoints bounds the number of points retained by Push. The
+	// oldest points are dropped once it is exceeded. Zero means unbounded.
+	// When Interval is set, it bounds the number of buckets instead.
+	MaxDataPoints int
 }
 
 type Anomalyzer struct {
 	Conf *AnomalyzerConf
 	Data govector.Vector
+
+	// the locks and the most recent probability, shared by every copy of
+	// the anomalyzer so that copying it does not copy its locks, and Eval
+	// can still take the anomalyzer by value
+	*locks
+
+	// random source for the permutation tests, and the source it draws
+	// from, nil unless Conf.Seed is set
+	rand   *rand.Rand
+	source *lockedSource
+
+	// reused by the evaluations made while pushing, which hold the write
+	// lock, so that pushing does not allocate afresh for every point
+	scratch scratch
+
+	// the time at which each point in Data was observed, zero for points
+	// added without one
+	times []time.Time
+
+	// the number of points added since the anomalyzer was created or
+	// last reset, including any that have since been dropped
+	seen int
+
+	// maps the combined probability to a calibrated one, nil unless
+	// Calibrate has been called
+	calibration *calibration
+
+	// the recent probabilities of each method from pushes, which they
+	// are normalized against when Conf.NormalizeMethods is set
+	history map[string]govector.Vector
+
+	// called when the state from a push becomes anomalous, followed by
+	// the current state and the number of consecutive pushes at or above
+	// the threshold
+	onAnomaly func(prob, value float64)
+	alerting  bool
+	streak    int
+}
+
+type locks struct {
+	// guards Data so that Push, Update and Eval may be called
+	// from multiple goroutines
+	mu sync.RWMutex
+
+	// the most recently computed probability, guarded separately since
+	// Eval only holds the read lock
+	lastMu  sync.Mutex
+	last    float64
+	hasLast bool
+}
+
+// A rand.Source that is safe for concurrent use, since several Evals
+// may hold the read lock at once.  It is a SplitMix64 generator, whose
+// whole state is a single word, so that the state can be saved along with
+// the anomalyzer and restored to carry on drawing where it left off.
+type lockedSource struct {
+	mu  sync.Mutex
+	src splitMix
+}
+
+func (s *lockedSource) Int63() int64 {
+	return int64(s.Uint64() >> 1)
+}
+
+func (s *lockedSource) Uint64() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Uint64()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.setState(uint64(seed))
+}
+
+func (s *lockedSource) getState() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.state
+}
+
+func (s *lockedSource) setState(state uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.src.state = state
+}
+
+// The SplitMix64 generator behind lockedSource.  On its own it is not safe
+// for concurrent use, but it is cheap to seed, which is what the chunks of
+// the ks test's permutations need.
+type splitMix struct {
+	state uint64
+}
+
+func (s *splitMix) Int63() int64 {
+	return int64(s.Uint64() >> 1)
+}
+
+func (s *splitMix) Uint64() uint64 {
+	s.state += 0x9e3779b97f4a7c15
+	z := s.state
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+func (s *splitMix) Seed(seed int64) {
+	s.state = uint64(seed)
+}
+
+// Return a random source seeded with seed, along with the random number
+// generator drawing from it, or nils to use the global source when seed is
+// zero.
+func newRand(seed int64) (*rand.Rand, *lockedSource) {
+	if seed == 0 {
+		return nil, nil
+	}
+	source := &lockedSource{src: splitMix{state: uint64(seed)}}
+	return rand.New(source), source
 }
 
 func validateConf(conf *AnomalyzerConf) error {
-	// if supplied, make sure the detection methods are supported
-	supportedMethods := []string{"magnitude", "diff", "highrank", "lowrank", "fence", "ks", "cdf"}
+	// if supplied, make sure the detection methods are supported,
+	// either as built-ins or registered through RegisterMethod
 	minimumMethods := []string{"magnitude", "ks"}
 	if conf.Methods == nil {
 		conf.Methods = minimumMethods
 	} else {
 		for _, method := range conf.Methods {
-			if !exists(method, supportedMethods) {
+			if _, ok := lookupAlgorithm(method); !ok {
 				return fmt.Errorf("Unsupported detection method '%s'", method)
 			}
 		}
@@ -46,18 +338,144 @@ func validateConf(conf *AnomalyzerConf) error {
 		conf.NSeasons = 4
 	}
 
-	// make reference window some multiple of the active window size
-	conf.referenceSize = conf.NSeasons * conf.ActiveSize
+	// make reference window some multiple of the active window size,
+	// unless a size was given explicitly
+	if conf.ReferenceSize < 0 {
+		return fmt.Errorf("ReferenceSize (%d) must not be negative", conf.ReferenceSize)
+	}
+	if conf.ReferenceSize > 0 {
+		conf.referenceSize = conf.ReferenceSize
+	} else {
+		conf.referenceSize = conf.NSeasons * conf.ActiveSize
+	}
 
 	// window sizes must be positive ints
 	if conf.ActiveSize < 1 {
 		return fmt.Errorf("Active window size must be at least of size 1")
 	}
 
+	if conf.ReferenceSize > 0 && conf.referenceSize < 4 {
+		return fmt.Errorf("The reference window (%d) is too small for analysis.  Please increase ReferenceSize to at least 4.", conf.ReferenceSize)
+	}
 	if conf.referenceSize < 4 {
 		return fmt.Errorf("The combination of active window (%d) and nseasons (%d) yields a reference window that is too small for analysis.  Please increase one or both.", conf.ActiveSize, conf.NSeasons)
 	}
 
+	// a phase-aligned reference window takes the active window's length
+	// from each season, so its size cannot be given separately
+	if conf.SeasonLength < 0 {
+		return fmt.Errorf("SeasonLength (%d) must not be negative", conf.SeasonLength)
+	}
+	if conf.SeasonalReference {
+		if conf.ReferenceSize > 0 {
+			return fmt.Errorf("ReferenceSize cannot be combined with SeasonalReference")
+		}
+		if conf.SeasonLength < conf.ActiveSize {
+			return fmt.Errorf("SeasonLength (%d) must be at least the active window size (%d) when SeasonalReference is set", conf.SeasonLength, conf.ActiveSize)
+		}
+	}
+
+	// methods comparing the active window against the reference need at
+	// least an active window's worth of reference points, one more for those
+	// working on differences, and ks needs the reference to split evenly
+	// into active windows
+	if exists("highrank", conf.Methods) || exists("lowrank", conf.Methods) || exists("ks", conf.Methods) {
+		if conf.referenceSize < conf.ActiveSize {
+			return fmt.Errorf("The reference window (%d) must be at least as big as the active window (%d) for the rank and ks tests", conf.referenceSize, conf.ActiveSize)
+		}
+	}
+	if exists("diff", conf.Methods) || exists("cdf", conf.Methods) {
+		if conf.referenceSize <= conf.ActiveSize {
+			return fmt.Errorf("The reference window (%d) must be bigger than the active window (%d) for the diff and cdf tests", conf.referenceSize, conf.ActiveSize)
+		}
+	}
+	if exists("ks", conf.Methods) && conf.referenceSize%conf.ActiveSize != 0 {
+		return fmt.Errorf("The reference window (%d) must be a multiple of the active window (%d) for the ks test", conf.referenceSize, conf.ActiveSize)
+	}
+
+	if conf.Threshold == 0 {
+		conf.Threshold = 0.8
+	}
+	if conf.Threshold < 0 || conf.Threshold > 1 {
+		return fmt.Errorf("Threshold (%v) must be between 0 and 1", conf.Threshold)
+	}
+
+	if conf.ExitThreshold == 0 {
+		conf.ExitThreshold = conf.Threshold
+	}
+	if conf.ExitThreshold < 0 || conf.ExitThreshold > conf.Threshold {
+		return fmt.Errorf("ExitThreshold (%v) must be between 0 and the Threshold (%v)", conf.ExitThreshold, conf.Threshold)
+	}
+	if conf.MinConsecutive == 0 {
+		conf.MinConsecutive = 1
+	}
+	if conf.MinConsecutive < 0 {
+		return fmt.Errorf("MinConsecutive (%d) must not be negative", conf.MinConsecutive)
+	}
+
+	if conf.WarningThreshold == 0 {
+		conf.WarningThreshold = 0.8
+	}
+	if conf.CriticalThreshold == 0 {
+		conf.CriticalThreshold = 0.95
+	}
+	if conf.WarningThreshold < 0 || conf.CriticalThreshold > 1 {
+		return fmt.Errorf("WarningThreshold (%v) and CriticalThreshold (%v) must be between 0 and 1", conf.WarningThreshold, conf.CriticalThreshold)
+	}
+	if conf.WarningThreshold > conf.CriticalThreshold {
+		return fmt.Errorf("WarningThreshold (%v) was higher than the CriticalThreshold (%v)", conf.WarningThreshold, conf.CriticalThreshold)
+	}
+
+	if conf.Aggregation == "" {
+		conf.Aggregation = "weighted"
+	}
+	if !exists(conf.Aggregation, []string{"weighted", "mean", "max"}) {
+		return fmt.Errorf("Unsupported aggregation '%s'", conf.Aggregation)
+	}
+
+	// custom weights must be non-negative and refer to configured methods
+	for method, weight := range conf.Weights {
+		if !exists(method, conf.Methods) {
+			return fmt.Errorf("Weight supplied for method '%s' which is not in Methods", method)
+		}
+		if weight < 0 {
+			return fmt.Errorf("Weight for method '%s' must not be negative (%v)", method, weight)
+		}
+	}
+
+	if conf.Interval < 0 {
+		return fmt.Errorf("Interval (%v) must not be negative", conf.Interval)
+	}
+
+	if conf.Warmup < 0 {
+		return fmt.Errorf("Warmup (%d) must not be negative", conf.Warmup)
+	}
+
+	// bounded retention must still leave room for both windows
+	if conf.MaxDataPoints < 0 {
+		return fmt.Errorf("MaxDataPoints (%d) must not be negative", conf.MaxDataPoints)
+	}
+	if conf.MaxDataPoints > 0 && conf.MaxDataPoints < conf.minDataPoints() {
+		return fmt.Errorf("MaxDataPoints (%d) must be at least the active window plus the reference window (%d)", conf.MaxDataPoints, conf.minDataPoints())
+	}
+
+	// and so must forgetting, which also replaces the other ways of
+	// shaping the reference window
+	if conf.ForgetFactor < 0 || conf.ForgetFactor >= 1 {
+		return fmt.Errorf("ForgetFactor (%v) must be between 0 and 1", conf.ForgetFactor)
+	}
+	if conf.ForgetFactor > 0 {
+		if conf.forgetSize() < conf.minDataPoints() {
+			return fmt.Errorf("ForgetFactor (%v) keeps only %d points, fewer than the active window plus the reference window (%d)", conf.ForgetFactor, conf.forgetSize(), conf.minDataPoints())
+		}
+		if conf.SeasonalReference {
+			return fmt.Errorf("ForgetFactor cannot be combined with SeasonalReference")
+		}
+		if conf.HalfLife > 0 {
+			return fmt.Errorf("ForgetFactor cannot be combined with HalfLife")
+		}
+	}
+
 	// validation for the fence test
 	if exists("fence", conf.Methods) {
 		if conf.UpperBound == conf.LowerBound {
@@ -82,9 +500,70 @@ func validateConf(conf *AnomalyzerConf) error {
 		}
 	}
 
+	if conf.HalfLife < 0 {
+		return fmt.Errorf("HalfLife (%v) must not be negative", conf.HalfLife)
+	}
+
+	if exists("quantile", conf.Methods) {
+		if conf.LowerQuantile == 0.0 {
+			conf.LowerQuantile = 0.01
+		}
+		if conf.UpperQuantile == 0.0 {
+			conf.UpperQuantile = 0.99
+		}
+		if conf.LowerQuantile < 0 || conf.UpperQuantile > 1 || conf.LowerQuantile >= conf.UpperQuantile {
+			return fmt.Errorf("LowerQuantile (%v) and UpperQuantile (%v) must be increasing and between 0 and 1", conf.LowerQuantile, conf.UpperQuantile)
+		}
+	}
+
+	if exists("ewma", conf.Methods) {
+		if conf.EwmaDecay == 0.0 {
+			conf.EwmaDecay = 0.3
+		}
+		if conf.EwmaDecay < 0 || conf.EwmaDecay > 1 {
+			return fmt.Errorf("EwmaDecay (%v) must be between 0 and 1", conf.EwmaDecay)
+		}
+	}
+
+	if exists("cusum", conf.Methods) {
+		if conf.CusumSlack == 0.0 {
+			conf.CusumSlack = 0.25
+		}
+		if conf.CusumSlack < 0 {
+			return fmt.Errorf("CusumSlack (%v) must not be negative", conf.CusumSlack)
+		}
+	}
+
 	return nil
 }
 
+// The number of points needed to fill both the active and reference windows.
+func (conf *AnomalyzerConf) minDataPoints() int {
+	if conf.SeasonalReference {
+		return conf.ActiveSize + conf.NSeasons*conf.SeasonLength
+	}
+	return conf.ActiveSize + conf.referenceSize
+}
+
+// The number of points retained by Push, or zero if they are all retained.
+func (conf *AnomalyzerConf) maxDataPoints() int {
+	size := conf.MaxDataPoints
+	if conf.ForgetFactor > 0 && (size == 0 || conf.forgetSize() < size) {
+		size = conf.forgetSize()
+	}
+	return size
+}
+
+// The number of points of the series the tests are run over that are
+// needed, which is every point still carrying weight when ForgetFactor is
+// set, and otherwise just enough to fill both windows.
+func (conf *AnomalyzerConf) seriesSize() int {
+	if conf.ForgetFactor > 0 {
+		return conf.maxDataPoints()
+	}
+	return conf.minDataPoints()
+}
+
 func index(needle string, haystack []string) int {
 	for i, straw := range haystack {
 		if straw == needle {
@@ -109,66 +588,701 @@ func NewAnomalyzer(conf *AnomalyzerConf, data []float64) (Anomalyzer, error) {
 	if err != nil {
 		return Anomalyzer{}, err
 	}
+	for _, val := range vector {
+		if err := checkFinite(val); err != nil {
+			return Anomalyzer{}, err
+		}
+	}
 
-	return Anomalyzer{conf, vector}, nil
+	// with an interval, the points have no timestamps and so all fall
+	// into a single bucket
+	seen := len(vector)
+	if size := conf.maxDataPoints(); size > 0 && conf.Interval <= 0 {
+		vector = truncate(vector, size)
+	}
+
+	rng, source := newRand(conf.Seed)
+	return Anomalyzer{
+		Conf:   conf,
+		Data:   vector,
+		rand:   rng,
+		source: source,
+		times:  make([]time.Time, len(vector)),
+		seen:   seen,
+		locks:  &locks{},
+	}, nil
+}
+
+// Return an error if x is NaN or infinite, since a single such value
+// would poison every window it is part of.
+func checkFinite(x float64) error {
+	if math.IsNaN(x) || math.IsInf(x, 0) {
+		return fmt.Errorf("Value %v is not a finite number", x)
+	}
+	return nil
 }
 
-func (a *Anomalyzer) Update(x []float64) {
+// Add the new elements to the data, keeping only as many points as the
+// windows require.  If any of the elements is NaN or infinite, an error is
+// returned and none of them are added.
+func (a *Anomalyzer) Update(x []float64) error {
+	for _, val := range x {
+		if err := checkFinite(val); err != nil {
+			return err
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
 	// add new elememnts to the vector
+	now := a.now()
 	for _, val := range x {
 		a.Data.Push(val)
+		a.times = append(a.times, now)
 	}
+	a.seen += len(x)
 
 	// truncate the vector to avoid overflow
-	offset := len(a.Data) - (a.Conf.ActiveSize + a.Conf.referenceSize)
-	if offset < 0 {
-		offset = 0
+	a.trim(a.Conf.seriesSize())
+	a.setLast(0, false)
+	a.scratch.stats.valid = false
+	return nil
+}
+
+// Drop the oldest points, along with their timestamps, so that at most size
+// points remain or, when Conf.Interval is set, so that they resample to at
+// most size buckets.
+func (a *Anomalyzer) trim(size int) {
+	times := a.alignedTimes()
+	keep := len(times) - a.retainFrom(times, size)
+	a.Data = truncate(a.Data, keep)
+	a.times = truncateTimes(times, keep)
+}
+
+// truncate drops the oldest points so that at most size points remain. The
+// oldest points are sliced off rather than the rest shifted down, so that
+// dropping a point for every one pushed costs the same however many are
+// kept.  The remaining points are only moved once the capacity after them
+// runs out, when appending reallocates them into a new array, which bounds
+// the space held by the dropped points to a multiple of size.
+func truncate(vector govector.Vector, size int) govector.Vector {
+	offset := len(vector) - size
+	if offset <= 0 {
+		return vector
 	}
-	a.Data = a.Data[offset:]
+	return vector[offset:]
 }
 
-func (a *Anomalyzer) Push(x float64) float64 {
+// truncateTimes is the equivalent of truncate for timestamps.
+func truncateTimes(times []time.Time, size int) []time.Time {
+	offset := len(times) - size
+	if offset <= 0 {
+		return times
+	}
+	return times[offset:]
+}
+
+// Add a new point to the data and return the updated anomalous
+// probability.  NaN and infinite values are rejected with an error and are
+// not stored.
+// The point is stored without a timestamp, unless Conf.Interval is set, in
+// which case it is stamped with the current time.
+func (a *Anomalyzer) Push(x float64) (float64, error) {
+	return a.push(time.Time{}, x)
+}
+
+func (a *Anomalyzer) push(t time.Time, x float64) (float64, error) {
+	if err := checkFinite(x); err != nil {
+		return 0, err
+	}
+
+	prob, alerts := a.pushLocked(t, x)
+	a.notify(alerts)
+	return prob, nil
+}
+
+func (a *Anomalyzer) pushLocked(t time.Time, x float64) (float64, []alert) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
 	// add the new point to the data
+	if t.IsZero() {
+		t = a.now()
+	}
+	a.scratch.stats.push(a.Data, x, a.Conf)
 	a.Data.Push(x)
+	a.times = append(a.times, t)
+	a.seen++
+
+	// drop the oldest points if retention is bounded
+	if size := a.Conf.maxDataPoints(); size > 0 {
+		a.trim(size)
+	}
 
 	// evaluate the anomalous probability
-	return a.Eval()
+	prob, ok := a.evalScratch()
+	a.setLast(prob, ok)
+	return prob, a.observe(nil, prob, x)
+}
+
+// Push each of the values in turn, returning the probability after each
+// one, or only the probability after the last one if finalOnly is set.
+// The result is the same as pushing the values one at a time, but the data
+// is grown and trimmed once for the whole batch.  If any of the values is
+// NaN or infinite, an error is returned and none of them are added.
+func (a *Anomalyzer) PushBatch(xs []float64, finalOnly bool) ([]float64, error) {
+	for _, x := range xs {
+		if err := checkFinite(x); err != nil {
+			return nil, err
+		}
+	}
+	if len(xs) == 0 {
+		return []float64{}, nil
+	}
+
+	probs, alerts := a.pushBatchLocked(xs, finalOnly)
+	a.notify(alerts)
+	return probs, nil
+}
+
+func (a *Anomalyzer) pushBatchLocked(xs []float64, finalOnly bool) ([]float64, []alert) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	start, seen := len(a.Data), a.seen
+	a.Data = append(a.Data, xs...)
+	a.times = a.alignedTimes()
+	now := a.now()
+	for range xs {
+		a.times = append(a.times, now)
+	}
+	a.seen += len(xs)
+
+	if finalOnly {
+		if size := a.Conf.maxDataPoints(); size > 0 {
+			a.trim(size)
+		}
+		a.scratch.stats.valid = false
+		prob, ok := a.evalScratch()
+		a.setLast(prob, ok)
+		return []float64{prob}, a.observe(nil, prob, xs[len(xs)-1])
+	}
+
+	// evaluate each point over the view of the data that a single Push
+	// would have retained at that point
+	data, times := a.Data, a.times
+	probs := make([]float64, len(xs))
+	var alerts []alert
+	var ok bool
+	for i, x := range xs {
+		end := start + i + 1
+		begin := 0
+		if size := a.Conf.maxDataPoints(); size > 0 {
+			begin = a.retainFrom(times[:end], size)
+		}
+		a.Data, a.times = data[begin:end], times[begin:end]
+		a.seen = seen + i + 1
+		a.scratch.stats.valid = false
+		probs[i], ok = a.evalScratch()
+		alerts = a.observe(alerts, probs[i], x)
+	}
+	a.Data, a.times = data, times
+
+	if size := a.Conf.maxDataPoints(); size > 0 {
+		a.trim(size)
+	}
+	a.setLast(probs[len(probs)-1], ok)
+	return probs, alerts
+}
+
+// Remove and return the oldest point in the data.  An error is returned if
+// there is no data to remove.
+func (a *Anomalyzer) Pop() (float64, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.Data) == 0 {
+		return 0, fmt.Errorf("Cannot pop from an anomalyzer with no data")
+	}
+
+	x := a.Data[0]
+	a.Data = a.Data[1:]
+	if len(a.times) > 0 {
+		a.times = a.times[1:]
+	}
+	a.setLast(0, false)
+	a.scratch.stats.valid = false
+	return x, nil
+}
+
+// Return an independent copy of the anomalyzer, with its own copies of the
+// configuration and data, so that changes to one do not affect the other.
+// If Seed is set, the clone draws from a new random source seeded with it,
+// just as a newly created anomalyzer would.  The anomaly handler is not
+// copied, so pushing hypothetical values into a clone never raises alerts.
+func (a *Anomalyzer) Clone() *Anomalyzer {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	conf := copyConf(a.Conf)
+	var history map[string]govector.Vector
+	if a.history != nil {
+		history = make(map[string]govector.Vector, len(a.history))
+		for method, probs := range a.history {
+			history[method] = copyVector(probs)
+		}
+	}
+
+	last, hasLast := a.LastProbability()
+	rng, source := newRand(conf.Seed)
+	return &Anomalyzer{
+		Conf:        conf,
+		Data:        copyVector(a.Data),
+		rand:        rng,
+		source:      source,
+		times:       append([]time.Time(nil), a.alignedTimes()...),
+		seen:        a.seen,
+		calibration: a.calibration,
+		history:     history,
+		alerting:    a.alerting,
+		streak:      a.streak,
+		locks:       &locks{last: last, hasLast: hasLast},
+	}
+}
+
+// Return a copy of the configuration that shares none of its slices or
+// maps with the original.
+func copyConf(conf *AnomalyzerConf) *AnomalyzerConf {
+	copied := *conf
+	copied.Methods = append([]string(nil), conf.Methods...)
+	if conf.Weights != nil {
+		copied.Weights = make(map[string]float64, len(conf.Weights))
+		for method, weight := range conf.Weights {
+			copied.Weights[method] = weight
+		}
+	}
+	return &copied
+}
+
+// Add a detection method to Conf.Methods, so that it is used from the next
+// Eval on.  An error is returned if the method is not supported or the
+// configuration is not valid with it, for instance if a fence test is
+// enabled without bounds.  Enabling a method that is already in use does
+// nothing.
+func (a *Anomalyzer) EnableMethod(name string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if exists(name, a.Conf.Methods) {
+		return nil
+	}
+
+	methods := append(append([]string(nil), a.Conf.Methods...), name)
+	return a.setMethods(methods, a.Conf.Weights)
+}
+
+// Remove a detection method, along with any weight configured for it, from
+// Conf.Methods.  An error is returned if the method is not in use or if it
+// is the only method left.
+func (a *Anomalyzer) DisableMethod(name string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	i := index(name, a.Conf.Methods)
+	if i < 0 {
+		return fmt.Errorf("Detection method '%s' is not enabled", name)
+	}
+	if len(a.Conf.Methods) == 1 {
+		return fmt.Errorf("Cannot disable '%s', the only remaining detection method", name)
+	}
+
+	methods := append(append([]string(nil), a.Conf.Methods[:i]...), a.Conf.Methods[i+1:]...)
+
+	var weights map[string]float64
+	if a.Conf.Weights != nil {
+		weights = make(map[string]float64, len(a.Conf.Weights))
+		for method, weight := range a.Conf.Weights {
+			if method != name {
+				weights[method] = weight
+			}
+		}
+	}
+	return a.setMethods(methods, weights)
+}
+
+// Validate the configuration with the new methods and weights before
+// replacing the current ones, so that a failure leaves it unchanged.
+func (a *Anomalyzer) setMethods(methods []string, weights map[string]float64) error {
+	conf := *a.Conf
+	conf.Methods = methods
+	conf.Weights = weights
+	if err := validateConf(&conf); err != nil {
+		return err
+	}
+
+	*a.Conf = conf
+	a.setLast(0, false)
+	return nil
+}
+
+// Discard all of the data, keeping the configuration, so that the
+// anomalyzer behaves as if it had just been created with no data.
+func (a *Anomalyzer) Reset() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.Data = a.Data[:0]
+	a.times = a.times[:0]
+	a.seen = 0
+	a.alerting = false
+	a.streak = 0
+	a.history = nil
+	a.rand, a.source = newRand(a.Conf.Seed)
+	a.setLast(0, false)
+	a.scratch.stats.valid = false
+}
+
+// Return the number of points needed to fill both the active and reference
+// windows, before which Eval always returns 0.  When Interval is set, this
+// counts resampled buckets rather than pushed points.  Eval can be held off
+// for longer still by Warmup.
+func (a *Anomalyzer) MinDataPoints() int {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return a.Conf.minDataPoints()
+}
+
+// Reports whether the anomalyzer has seen at least Warmup points and has
+// enough data to fill both windows, so that Eval yields a real probability.
+func (a *Anomalyzer) Ready() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return a.seen >= a.Conf.Warmup && len(a.sampled()) >= a.Conf.minDataPoints()
 }
 
 // Return the weighted average of all statistical tests
 // for anomaly detection, which yields the probability that
-// the currently observed behavior is anomalous.
-func (a Anomalyzer) Eval() float64 {
-	probmap := make(map[string]float64)
-	for _, method := range a.Conf.Methods {
-
-		algorithm := Algorithms[method]
-		prob := cap(algorithm(a.Data, *a.Conf), 0, 1)
-
-		if prob != NA {
-			// if highrank and lowrank methods exist then only listen to
-			// the max of either
-			if method == "highrank" || method == "lowrank" {
-				if math.IsNaN(probmap["rank"]) {
-					probmap["rank"] = 0
-				}
-				probmap["rank"] = math.Max(probmap["rank"], prob)
-			} else {
-				probmap[method] = prob
+// the currently observed behavior is anomalous.  Until there
+// is enough data to fill both windows, and at least Warmup points have
+// been added, the probability is 0.
+func (a *Anomalyzer) Eval() float64 {
+	prob, _ := a.EvalContext(context.Background())
+	return prob
+}
+
+// Like Eval, but gives up and returns the context's error if ctx is
+// cancelled or its deadline passes before the evaluation completes.
+// ErrInsufficientData is returned until there is enough data to fill
+// both windows.
+func (a *Anomalyzer) EvalContext(ctx context.Context) (float64, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	prob, err := a.evalContext(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	a.setLast(prob, true)
+	return prob, nil
+}
+
+// Return the probability computed by the most recent Push, Eval or
+// EvalDirection without recomputing it.  The boolean is false if there
+// was not enough data for that evaluation, or if no probability has been
+// computed since the data last changed through some other means, such as
+// Update or Pop.
+func (a *Anomalyzer) LastProbability() (float64, bool) {
+	a.lastMu.Lock()
+	defer a.lastMu.Unlock()
+
+	return a.last, a.hasLast
+}
+
+func (a *Anomalyzer) setLast(prob float64, ok bool) {
+	a.lastMu.Lock()
+	defer a.lastMu.Unlock()
+
+	a.last, a.hasLast = prob, ok
+}
+
+// Return the anomalous probability along with whether the active window
+// moved up or down relative to the reference window.  The direction is
+// DirectionNone when the probability is below the configured Threshold.
+func (a *Anomalyzer) EvalDirection() (float64, Direction) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	prob, err := a.evalContext(context.Background(), nil)
+	if err != nil {
+		return 0, DirectionNone
+	}
+	a.setLast(prob, true)
+	if prob < a.Conf.Threshold {
+		return prob, DirectionNone
+	}
+
+	reference, active := a.windows()
+	if len(reference) == 0 {
+		return prob, DirectionNone
+	}
+
+	diff := active.Mean() - reference.Mean()
+	switch {
+	case diff > 0:
+		return prob, DirectionUp
+	case diff < 0:
+		return prob, DirectionDown
+	}
+	return prob, DirectionNone
+}
+
+// Return a copy of the active window that the next Eval will consider.
+func (a *Anomalyzer) ActiveWindow() govector.Vector {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	_, active := a.windows()
+	return copyVector(active)
+}
+
+// Return a copy of the reference window that the next Eval will consider.
+// When ForgetFactor is set, this is the reference window of the magnitude,
+// fence and cdf tests, every retained point before the active window,
+// which those tests weight by age.
+func (a *Anomalyzer) ReferenceWindow() govector.Vector {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	reference, _ := a.windows()
+	return copyVector(reference)
+}
+
+// Return the reference and active windows of the series the tests are run
+// over.  Either may be shorter than configured if there is not yet enough
+// data.
+func (a *Anomalyzer) windows() (govector.Vector, govector.Vector) {
+	if a.Conf.ForgetFactor > 0 {
+		reference, active, _, _ := forgetWindows(a.series(), *a.Conf)
+		return reference, active
+	}
+	reference, active, _ := extractWindows(a.series(), a.Conf.referenceSize, a.Conf.ActiveSize, -1)
+	return reference, active
+}
+
+// Space reused from one evaluation to the next: the per-method
+// probabilities, the vectors they are combined from, the buffers of the
+// permutation tests and the running statistics of the windows.
+type scratch struct {
+	probmap        map[string]float64
+	probs, weights govector.Vector
+	buffers        buffers
+	stats          windowStats
+}
+
+// Return empty vectors with room for n probabilities and their weights,
+// reusing those held by s unless it is nil.
+func (s *scratch) vectors(n int) (govector.Vector, govector.Vector) {
+	if s == nil {
+		return make(govector.Vector, 0, n), make(govector.Vector, 0, n)
+	}
+	s.probs, s.weights = grow(s.probs, n), grow(s.weights, n)
+	return s.probs[:0], s.weights[:0]
+}
+
+func copyVector(vector govector.Vector) govector.Vector {
+	copied := make(govector.Vector, len(vector))
+	copy(copied, vector)
+	return copied
+}
+
+// Classify a probability as a warning or critical anomaly according to the
+// configured WarningThreshold and CriticalThreshold.
+func (a *Anomalyzer) Classify(prob float64) Severity {
+	switch {
+	case prob >= a.Conf.CriticalThreshold:
+		return SeverityCritical
+	case prob >= a.Conf.WarningThreshold:
+		return SeverityWarning
+	}
+	return SeverityNone
+}
+
+// Evaluate the anomalous probability and return its classified severity.
+func (a *Anomalyzer) EvalSeverity() Severity {
+	return a.Classify(a.Eval())
+}
+
+// eval does the work of Eval and expects the caller to hold the lock.
+func (a *Anomalyzer) eval() float64 {
+	prob, _ := a.evalContext(context.Background(), nil)
+	return prob
+}
+
+// Like eval, but reuses the anomalyzer's scratch space, so expects the
+// caller to hold the write lock.  The boolean is false if there was not
+// enough data to evaluate.
+func (a *Anomalyzer) evalScratch() (float64, bool) {
+	prob, err := a.evalContext(context.Background(), &a.scratch)
+	return prob, err == nil
+}
+
+// evalContext does the work of EvalContext and expects the caller to hold
+// the lock.  If s is not nil, its space is reused for the evaluation and the
+// probabilities of the methods are recorded in their histories, so the
+// caller must hold the write lock.
+func (a *Anomalyzer) evalContext(ctx context.Context, s *scratch) (float64, error) {
+	var start time.Time
+	if a.Conf.Observer != nil {
+		start = time.Now()
+	}
+
+	probmap, err := a.evalByMethodContext(ctx, s, nil)
+	if err != nil {
+		return 0, err
+	}
+	prob := a.calibrate(a.combine(probmap, s))
+	if s != nil {
+		a.record(probmap)
+	}
+
+	if a.Conf.Observer != nil {
+		a.Conf.Observer.ObserveEvalDuration(time.Since(start))
+	}
+	return prob, nil
+}
+
+// Return the probability yielded by each of the configured detection
+// methods, keyed by the method name used in Conf.Methods.  These are the
+// raw probabilities before any weighting or aggregation is applied.
+// Methods that could not be computed for the current data are omitted,
+// and the map is empty until there is enough data to fill both windows.
+func (a *Anomalyzer) EvalByMethod() map[string]float64 {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return a.evalByMethod()
+}
+
+// evalByMethod does the work of EvalByMethod and expects the caller to
+// hold the lock.
+func (a *Anomalyzer) evalByMethod() map[string]float64 {
+	probmap, err := a.evalByMethodContext(context.Background(), nil, nil)
+	if err != nil {
+		return map[string]float64{}
+	}
+	return probmap
+}
+
+// Run each of the configured methods, stopping early with the context's
+// error if it is cancelled.  If s is not nil, the map returned is the one
+// held by s, and is only valid until s is next used.  If permutations is
+// not nil, the number of permutations is recorded in it for each method
+// whose probability was estimated by permutation.
+func (a *Anomalyzer) evalByMethodContext(ctx context.Context, s *scratch, permutations map[string]int) (map[string]float64, error) {
+	conf := *a.Conf
+	conf.rand = a.rand
+	conf.ctx = ctx
+
+	series := a.sampled()
+	if len(series) < conf.minDataPoints() || a.seen < conf.Warmup {
+		return nil, ErrInsufficientData
+	}
+	if conf.SeasonalReference {
+		series = seasonalSeries(series, &conf)
+	}
+
+	var probmap map[string]float64
+	if s != nil {
+		if s.probmap == nil {
+			s.probmap = make(map[string]float64, len(conf.Methods))
+		}
+		for method := range s.probmap {
+			delete(s.probmap, method)
+		}
+		probmap = s.probmap
+		conf.buffers = &s.buffers
+		if conf.Interval <= 0 && !conf.SeasonalReference && conf.ForgetFactor == 0 {
+			s.stats.sync(series, &conf)
+			conf.stats = &s.stats
+		}
+	} else {
+		probmap = make(map[string]float64, len(conf.Methods))
+	}
+	for _, method := range conf.Methods {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		algorithm, ok := lookupAlgorithm(method)
+		if !ok {
+			continue
+		}
+		var n int
+		if permutations != nil {
+			conf.permutations = &n
+		}
+		result := algorithm(series, conf)
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if conf.Observer != nil {
+			conf.Observer.ObserveMethodResult(method, result)
+		}
+		prob := cap(result, 0, 1)
+
+		// windows that are too small for a method may yield NaN, which
+		// we treat the same as a method that could not be computed
+		if prob != NA && !math.IsNaN(prob) {
+			probmap[method] = prob
+			if n > 0 {
+				permutations[method] = n
 			}
 		}
 	}
+	return probmap, nil
+}
 
-	probs := make(govector.Vector, 0, len(probmap))
-	weights := make(govector.Vector, 0, len(probmap))
+// Combine the per-method probabilities into a single probability according
+// to the configured aggregation.
+func (a *Anomalyzer) combine(probmap map[string]float64, s *scratch) float64 {
+	probs, weights := s.vectors(len(probmap))
 
+	rank, rankMethod := 0.0, ""
 	for method, prob := range probmap {
+		// if highrank and lowrank methods exist then only listen to
+		// the max of either
+		if method == "highrank" || method == "lowrank" {
+			if rankMethod == "" || prob > rank {
+				rank, rankMethod = prob, method
+			}
+			continue
+		}
+
 		if method == "magnitude" && prob < a.Conf.Sensitivity {
 			return 0.0
 		}
+		prob = a.normalize(method, prob)
 		probs = append(probs, prob)
 		weights = append(weights, a.getWeight(method, prob))
 	}
+	if rankMethod != "" {
+		rank = a.normalize(rankMethod, rank)
+		probs = append(probs, rank)
+		weights = append(weights, a.getWeight(rankMethod, rank))
+	}
+
+	if len(probs) == 0 {
+		return 0
+	}
+	switch a.Conf.Aggregation {
+	case "mean":
+		return probs.Mean()
+	case "max":
+		return probs.Max()
+	}
 
 	// ignore the error since we force the length of probs
 	// and the weights to be equal
@@ -186,10 +1300,15 @@ func (a Anomalyzer) Eval() float64 {
 
 // Use essentially similar weights.  However, if either the magnitude
 // or fence methods have high probabilities, upweight them significantly.
-func (a Anomalyzer) getWeight(name string, prob float64) float64 {
+// Weights configured through Conf.Weights take precedence.
+func (a *Anomalyzer) getWeight(name string, prob float64) float64 {
+	if weight, ok := a.Conf.Weights[name]; ok {
+		return weight
+	}
+
 	weight := 0.5
 
-	dynamicWeights := []string{"magnitude", "fence"}
+	dynamicWeights := []string{"magnitude", "fence", "robustfence"}
 	// If either the magnitude and fence methods don't have any
 	// probability to contribute, we don't want to hear about it.
 	// If they do, we upweight them substantially.
@@ -1,9 +1,17 @@
 package anomalyzer
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"math"
 	"math/rand"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/bmizerany/assert"
 	"github.com/drewlanenga/govector"
@@ -41,7 +49,8 @@ func TestAnomalyzer(t *testing.T) {
 	anomalyzer, err := NewAnomalyzer(conf, data)
 	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
 
-	prob := anomalyzer.Push(8.0)
+	prob, err := anomalyzer.Push(8.0)
+	assert.Equal(t, nil, err, "Error pushing data")
 	assert.Tf(t, prob > 0.5, "Anomalyzer returned a probability that was too small")
 }
 
@@ -63,6 +72,2155 @@ func Example() {
 	// the push method automatically triggers a recalcuation of the
 	// anomaly probability.  The recalculation can also be triggered
 	// by a call to the Eval method.
-	prob := anom.Push(8.0)
+	prob, _ := anom.Push(8.0)
 	fmt.Println("Anomalous Probability:", prob)
 }
+
+func TestConcurrentPushAndEval(t *testing.T) {
+	conf := &AnomalyzerConf{
+		Sensitivity: 0.1,
+		UpperBound:  5,
+		LowerBound:  0,
+		ActiveSize:  1,
+		NSeasons:    4,
+		Methods:     []string{"cdf", "fence", "magnitude"},
+	}
+
+	data := []float64{0.1, 2.05, 1.5, 2.5, 2.6, 2.55}
+	anomalyzer, err := NewAnomalyzer(conf, data)
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if (i+j)%2 == 0 {
+					anomalyzer.Push(float64(j%5) + 0.5)
+				} else {
+					anomalyzer.Eval()
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, len(data)+500, len(anomalyzer.Data), "Pushed points were lost")
+
+	// a copy shares the locks of the original rather than duplicating them
+	copied := anomalyzer
+	assert.Equal(t, true, copied.locks == anomalyzer.locks, "Copies should share their locks")
+}
+
+func TestMaxDataPoints(t *testing.T) {
+	conf := &AnomalyzerConf{
+		Sensitivity:   0.1,
+		UpperBound:    5,
+		LowerBound:    0,
+		ActiveSize:    1,
+		NSeasons:      4,
+		MaxDataPoints: 8,
+		Methods:       []string{"cdf", "fence", "magnitude"},
+	}
+
+	anomalyzer, err := NewAnomalyzer(conf, nil)
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+
+	for i := 0; i < 100; i++ {
+		anomalyzer.Push(float64(i))
+		assert.Tf(t, len(anomalyzer.Data) <= 8, "Data grew beyond MaxDataPoints (%d)", len(anomalyzer.Data))
+	}
+	assert.Equal(t, govector.Vector{92, 93, 94, 95, 96, 97, 98, 99}, anomalyzer.Data)
+
+	// the windows need at least ActiveSize + NSeasons*ActiveSize points
+	conf = &AnomalyzerConf{
+		ActiveSize:    2,
+		NSeasons:      4,
+		MaxDataPoints: 9,
+		Methods:       []string{"cdf"},
+	}
+	_, err = NewAnomalyzer(conf, nil)
+	assert.NotEqual(t, nil, err, "MaxDataPoints smaller than the windows should be rejected")
+}
+
+func TestEvalByMethod(t *testing.T) {
+	conf := &AnomalyzerConf{
+		Sensitivity: 0.1,
+		UpperBound:  5,
+		LowerBound:  0,
+		ActiveSize:  1,
+		NSeasons:    4,
+		Methods:     []string{"cdf", "fence", "highrank", "lowrank", "magnitude"},
+	}
+
+	data := []float64{0.1, 2.05, 1.5, 2.5, 2.6, 2.55, 8.0}
+	anomalyzer, err := NewAnomalyzer(conf, data)
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+
+	probs := anomalyzer.EvalByMethod()
+	assert.Equal(t, len(conf.Methods), len(probs), "Expected a probability for each method")
+	for _, method := range conf.Methods {
+		prob, ok := probs[method]
+		assert.Tf(t, ok, "Missing probability for method %s", method)
+		assert.Tf(t, prob >= 0 && prob <= 1, "Probability for %s out of range (%f)", method, prob)
+	}
+
+	// the aggregated probability is derived from the per-method results
+	assert.Equal(t, anomalyzer.combine(map[string]float64{"magnitude": 0.05, "cdf": 1}, nil), 0.0)
+	assert.Tf(t, anomalyzer.Eval() > 0.5, "Anomalyzer returned a probability that was too small")
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	conf := &AnomalyzerConf{
+		Sensitivity: 0.1,
+		UpperBound:  5,
+		LowerBound:  NA,
+		ActiveSize:  1,
+		NSeasons:    4,
+		Methods:     []string{"cdf", "fence", "magnitude"},
+	}
+
+	data := []float64{0.1, 2.05, 1.5, 2.5, 2.6, 2.55}
+	original, err := NewAnomalyzer(conf, data)
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+
+	b, err := json.Marshal(&original)
+	assert.Equal(t, nil, err, "Error marshalling anomalyzer")
+
+	var restored Anomalyzer
+	err = json.Unmarshal(b, &restored)
+	assert.Equal(t, nil, err, "Error unmarshalling anomalyzer")
+	assert.Equal(t, *original.Conf, *restored.Conf)
+	expected, _ := original.Push(8.0)
+	actual, _ := restored.Push(8.0)
+	assert.Equal(t, expected, actual)
+
+	// restoring over a differently configured anomalyzer is an error
+	other, err := NewAnomalyzer(&AnomalyzerConf{ActiveSize: 2, NSeasons: 4, Methods: []string{"cdf"}}, nil)
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+	err = json.Unmarshal(b, &other)
+	assert.NotEqual(t, nil, err, "Expected an error for a mismatched configuration")
+	assert.Equal(t, "Serialized configuration does not match the current configuration in Sensitivity, UpperBound, LowerBound, ActiveSize, Methods", err.Error())
+	assert.Equal(t, 0, len(other.Data), "Data should be left untouched on error")
+
+	// a seeded anomalyzer resumes drawing where it left off
+	seeded, err := NewAnomalyzer(&AnomalyzerConf{ActiveSize: 1, NSeasons: 4, Seed: 7, Methods: []string{"highrank", "magnitude"}}, data)
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+	seeded.Push(3)
+	seeded.Push(2.8)
+	b, err = json.Marshal(&seeded)
+	assert.Equal(t, nil, err, "Error marshalling anomalyzer")
+	var resumed Anomalyzer
+	err = json.Unmarshal(b, &resumed)
+	assert.Equal(t, nil, err, "Error unmarshalling anomalyzer")
+	for _, x := range []float64{8, 2.5, 9} {
+		expected, _ := seeded.Push(x)
+		actual, _ := resumed.Push(x)
+		assert.Equal(t, expected, actual)
+	}
+}
+
+func TestLoadConf(t *testing.T) {
+	conf, err := LoadConf(strings.NewReader(`{"ActiveSize": 2, "Methods": ["magnitude", "ks"], "PermCount": 100}`))
+	assert.Equal(t, nil, err, "Error loading configuration")
+	assert.Equal(t, 2, conf.ActiveSize)
+	assert.Equal(t, []string{"magnitude", "ks"}, conf.Methods)
+	assert.Equal(t, 100, conf.PermCount)
+
+	// omitted fields take their defaults
+	assert.Equal(t, 4, conf.NSeasons)
+	assert.Equal(t, 0.1, conf.Sensitivity)
+	assert.Equal(t, 0.8, conf.Threshold)
+
+	_, err = NewAnomalyzer(conf, nil)
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer from loaded configuration")
+
+	_, err = LoadConf(strings.NewReader(`{"ActiveSize": 2, "PermCuont": 100}`))
+	assert.NotEqual(t, nil, err, "LoadConf accepted an unknown field")
+	_, err = LoadConf(strings.NewReader(`{"ActiveSize": 0}`))
+	assert.NotEqual(t, nil, err, "LoadConf accepted an invalid configuration")
+	_, err = LoadConf(strings.NewReader(`{"ActiveSize": 2`))
+	assert.NotEqual(t, nil, err, "LoadConf accepted malformed JSON")
+}
+
+func TestPop(t *testing.T) {
+	conf := &AnomalyzerConf{
+		Sensitivity: 0.1,
+		UpperBound:  5,
+		LowerBound:  0,
+		ActiveSize:  1,
+		NSeasons:    4,
+		Methods:     []string{"cdf", "fence", "magnitude"},
+	}
+
+	data := []float64{0.1, 2.05, 1.5, 2.5, 2.6, 2.55}
+	anomalyzer, err := NewAnomalyzer(conf, data)
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+
+	for _, expected := range data {
+		x, err := anomalyzer.Pop()
+		assert.Equal(t, nil, err, "Error popping data")
+		assert.Equal(t, expected, x)
+
+		prob := anomalyzer.Eval()
+		assert.Tf(t, prob >= 0 && prob <= 1, "Probability out of range (%f) with %d points", prob, len(anomalyzer.Data))
+	}
+
+	_, err = anomalyzer.Pop()
+	assert.NotEqual(t, nil, err, "Expected an error popping from empty data")
+}
+
+// Flags an active window with no variation at all.
+type flatlineMethod struct{}
+
+func (flatlineMethod) Name() string { return "flatline" }
+
+func (flatlineMethod) Run(active, reference govector.Vector, conf *AnomalyzerConf) float64 {
+	if active.Max() == active.Min() && reference.Max() != reference.Min() {
+		return 1
+	}
+	return 0
+}
+
+func init() {
+	if err := RegisterMethod(flatlineMethod{}); err != nil {
+		panic(err)
+	}
+}
+
+func TestRegisterMethod(t *testing.T) {
+	err := RegisterMethod(flatlineMethod{})
+	assert.NotEqual(t, nil, err, "Expected an error registering a duplicate method")
+
+	conf := &AnomalyzerConf{
+		ActiveSize: 3,
+		NSeasons:   2,
+		Methods:    []string{"flatline"},
+	}
+
+	data := []float64{1.2, 0.4, 2.1, 1.7, 0.3, 0.9}
+	anomalyzer, err := NewAnomalyzer(conf, data)
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+
+	anomalyzer.Update([]float64{1, 1, 1})
+	assert.Equal(t, map[string]float64{"flatline": 1}, anomalyzer.EvalByMethod())
+	assert.Equal(t, 1.0, anomalyzer.Eval())
+
+	_, err = NewAnomalyzer(&AnomalyzerConf{ActiveSize: 1, Methods: []string{"bogus"}}, nil)
+	assert.NotEqual(t, nil, err, "Expected an error for an unregistered method")
+}
+
+func TestWeights(t *testing.T) {
+	conf := &AnomalyzerConf{
+		UpperBound: 5,
+		LowerBound: 0,
+		ActiveSize: 1,
+		NSeasons:   4,
+		Methods:    []string{"cdf", "fence"},
+	}
+
+	data := []float64{0.1, 2.05, 1.5, 2.5, 2.6, 2.55, 4.0}
+	anomalyzer, err := NewAnomalyzer(conf, data)
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+
+	probs := anomalyzer.EvalByMethod()
+	unweighted := anomalyzer.Eval()
+
+	conf.Weights = map[string]float64{"cdf": 1, "fence": 3}
+	expected := (probs["cdf"] + 3*probs["fence"]) / 4
+	assert.Tf(t, math.Abs(anomalyzer.Eval()-expected) < 1e-12, "Expected weighted probability %f, got %f", expected, anomalyzer.Eval())
+
+	// an empty map leaves the default weighting in place
+	conf.Weights = map[string]float64{}
+	assert.Equal(t, unweighted, anomalyzer.Eval())
+
+	_, err = NewAnomalyzer(&AnomalyzerConf{ActiveSize: 1, Methods: []string{"cdf"}, Weights: map[string]float64{"cdf": -1}}, nil)
+	assert.NotEqual(t, nil, err, "Expected an error for a negative weight")
+
+	_, err = NewAnomalyzer(&AnomalyzerConf{ActiveSize: 1, Methods: []string{"cdf"}, Weights: map[string]float64{"fence": 1}}, nil)
+	assert.NotEqual(t, nil, err, "Expected an error for a weight on an unconfigured method")
+}
+
+func TestEvalDirection(t *testing.T) {
+	conf := &AnomalyzerConf{
+		Sensitivity: 0.1,
+		UpperBound:  5,
+		LowerBound:  0,
+		ActiveSize:  1,
+		NSeasons:    4,
+		Methods:     []string{"cdf", "fence", "magnitude"},
+	}
+
+	data := []float64{2.45, 2.55, 2.5, 2.6, 2.4, 2.5}
+
+	spike, err := NewAnomalyzer(conf, data)
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+	spike.Push(4.99)
+	prob, direction := spike.EvalDirection()
+	assert.Tf(t, prob >= conf.Threshold, "Expected an anomalous probability, got %f", prob)
+	assert.Equal(t, DirectionUp, direction)
+
+	drop, err := NewAnomalyzer(conf, data)
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+	drop.Push(0.01)
+	prob, direction = drop.EvalDirection()
+	assert.Tf(t, prob >= conf.Threshold, "Expected an anomalous probability, got %f", prob)
+	assert.Equal(t, DirectionDown, direction)
+
+	steady, err := NewAnomalyzer(conf, data)
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+	steady.Push(2.5)
+	_, direction = steady.EvalDirection()
+	assert.Equal(t, DirectionNone, direction)
+}
+
+func TestNonFinite(t *testing.T) {
+	conf := &AnomalyzerConf{
+		Sensitivity: 0.1,
+		UpperBound:  5,
+		LowerBound:  0,
+		ActiveSize:  1,
+		NSeasons:    4,
+		Methods:     []string{"cdf", "fence", "magnitude"},
+	}
+
+	data := []float64{0.1, 2.05, 1.5, 2.5, 2.6, 2.55}
+	anomalyzer, err := NewAnomalyzer(conf, data)
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+	before := anomalyzer.Eval()
+
+	for _, x := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		_, err = anomalyzer.Push(x)
+		assert.NotEqual(t, nil, err, "Expected an error pushing", x)
+	}
+	err = anomalyzer.Update([]float64{1, math.NaN()})
+	assert.NotEqual(t, nil, err, "Expected an error updating with NaN")
+
+	// the rejected values must not have been stored
+	assert.Equal(t, govector.Vector(data), anomalyzer.Data)
+	assert.Equal(t, before, anomalyzer.Eval())
+
+	_, err = NewAnomalyzer(conf, []float64{1, 2, math.Inf(1)})
+	assert.NotEqual(t, nil, err, "Expected an error initializing with Inf")
+
+	poisoned := govector.Vector{0.1, 2.05, math.NaN(), 2.5, 2.6, 2.55}
+	for _, method := range conf.Methods {
+		assert.Equal(t, NA, Algorithms[method](poisoned, *conf), method)
+	}
+}
+
+func TestSeed(t *testing.T) {
+	data := []float64{0.1, 2.05, 1.5, 2.5, 2.6, 2.55, 2.4, 2.7, 2.35}
+	newConf := func() *AnomalyzerConf {
+		return &AnomalyzerConf{
+			ActiveSize: 1,
+			NSeasons:   4,
+			PermCount:  100,
+			Seed:       42,
+			Methods:    []string{"diff", "highrank", "lowrank", "ks"},
+		}
+	}
+
+	first, err := NewAnomalyzer(newConf(), data)
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+	second, err := NewAnomalyzer(newConf(), data)
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+
+	for _, x := range []float64{3.1, 0.4, 2.5} {
+		expected, _ := first.Push(x)
+		actual, _ := second.Push(x)
+		assert.Equal(t, expected, actual, "Seeded anomalyzers diverged")
+	}
+	assert.Equal(t, first.EvalByMethod(), second.EvalByMethod())
+}
+
+func TestParallelBootstrapKs(t *testing.T) {
+	walk, _ := randomWalk(40, 0.5, 0.05)
+	walk = append(walk, 0.9, 0.95, 0.9, 0.92)
+
+	conf := &AnomalyzerConf{
+		ActiveSize: 4,
+		NSeasons:   4,
+		PermCount:  4000,
+		Methods:    []string{"ks"},
+	}
+	err := validateConf(conf)
+	assert.Equal(t, nil, err, "Error validating configuration")
+
+	conf.rand, _ = newRand(7)
+	serial := bootstrapKsTest(walk, *conf, 1)
+	conf.rand, _ = newRand(7)
+	parallel := bootstrapKsTest(walk, *conf, 4)
+
+	// each chunk of permutations is seeded in order before any is run,
+	// so the workers draw exactly the permutations a serial run would and
+	// the results are identical rather than merely close
+	assert.Equal(t, serial, parallel)
+
+	// a seeded parallel run is reproducible
+	conf.rand, _ = newRand(7)
+	assert.Equal(t, parallel, bootstrapKsTest(walk, *conf, 4))
+
+	// and so is a seeded anomalyzer, whatever GOMAXPROCS is
+	ks := func(procs int) float64 {
+		defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(procs))
+		anomalyzer, err := NewAnomalyzer(&AnomalyzerConf{ActiveSize: 4, NSeasons: 4, PermCount: 4000, Seed: 42, Methods: []string{"ks"}}, walk)
+		assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+		return anomalyzer.Eval()
+	}
+	assert.Equal(t, ks(1), ks(8))
+}
+
+func BenchmarkBootstrapKsTest(b *testing.B) {
+	walk, _ := randomWalk(200, 0.5, 0.05)
+	conf := &AnomalyzerConf{
+		ActiveSize: 10,
+		NSeasons:   10,
+		PermCount:  2000,
+		Methods:    []string{"ks"},
+	}
+	if err := validateConf(conf); err != nil {
+		b.Fatal(err)
+	}
+
+	// keep the scratch space across evaluations, as an anomalyzer does
+	conf.buffers = &buffers{}
+
+	b.Run("serial", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			bootstrapKsTest(walk, *conf, 1)
+		}
+	})
+	b.Run("parallel", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			bootstrapKsTest(walk, *conf, runtime.GOMAXPROCS(0))
+		}
+	})
+}
+
+func TestEvalContext(t *testing.T) {
+	walk, _ := randomWalk(200, 0.5, 0.05)
+	conf := &AnomalyzerConf{
+		ActiveSize: 10,
+		NSeasons:   10,
+		PermCount:  1000000,
+		Methods:    []string{"ks", "highrank"},
+	}
+
+	anomalyzer, err := NewAnomalyzer(conf, walk)
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = anomalyzer.EvalContext(ctx)
+	assert.Equal(t, context.Canceled, err)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = anomalyzer.EvalContext(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Tf(t, time.Since(start) < time.Second, "EvalContext ran well past its deadline (%v)", time.Since(start))
+}
+
+func TestEwma(t *testing.T) {
+	// a noisy baseline that steps up at onset
+	noise := []float64{0.3, -0.2, 0.1, -0.4, 0.2, 0.0, -0.1, 0.4, -0.3, 0.1}
+	onset := 40
+	series := make([]float64, 0, 60)
+	for i := 0; i < 60; i++ {
+		base := 10.0
+		if i >= onset {
+			base = 11.0
+		}
+		series = append(series, base+noise[i%len(noise)])
+	}
+
+	// index of the first point at or after the onset at which the
+	// method fires, along with its largest probability before the onset
+	detect := func(method string) (int, float64) {
+		conf := &AnomalyzerConf{
+			ActiveSize: 3,
+			NSeasons:   8,
+			Methods:    []string{method},
+		}
+		anomalyzer, err := NewAnomalyzer(conf, series[:30])
+		assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+
+		before := 0.0
+		for i := 30; i < len(series); i++ {
+			anomalyzer.Push(series[i])
+			prob := anomalyzer.EvalByMethod()[method]
+			if i < onset {
+				before = math.Max(before, prob)
+			} else if prob >= conf.Threshold {
+				return i, before
+			}
+		}
+		return len(series), before
+	}
+
+	ewma, before := detect("ewma")
+	cdf, _ := detect("cdf")
+	assert.Tf(t, before < 0.8, "ewma fired on the baseline (%f)", before)
+	assert.Tf(t, ewma < cdf, "ewma (%d) did not fire before cdf (%d)", ewma, cdf)
+}
+
+func TestPushAt(t *testing.T) {
+	conf := &AnomalyzerConf{
+		ActiveSize: 1,
+		NSeasons:   4,
+		Interval:   time.Minute,
+		Methods:    []string{"magnitude"},
+	}
+
+	anomalyzer, err := NewAnomalyzer(conf, nil)
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+
+	start := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	points := []struct {
+		offset time.Duration
+		value  float64
+	}{
+		{0, 1},
+		{20 * time.Second, 3},
+		{70 * time.Second, 4},
+		// a timestamp going backwards joins the previous bucket
+		{50 * time.Second, 6},
+		// nothing arrives during the third and fourth minutes
+		{4 * time.Minute, 7},
+		{5*time.Minute + 10*time.Second, 8},
+	}
+	for _, p := range points {
+		_, err := anomalyzer.PushAt(start.Add(p.offset), p.value)
+		assert.Equal(t, nil, err, "Error pushing data")
+	}
+
+	assert.Equal(t, len(points), len(anomalyzer.Timestamps()))
+	assert.Equal(t, start.Add(70*time.Second), anomalyzer.Timestamps()[2])
+	// only the buckets needed by the windows are kept, so the first
+	// minute (averaging to 2) has already been dropped
+	assert.Equal(t, govector.Vector{5, 5, 5, 7, 8}, anomalyzer.series())
+
+	// plain pushes are stamped with the time they arrive, so that they
+	// land in buckets of their own
+	before := time.Now()
+	anomalyzer.Push(9)
+	stamped := anomalyzer.Timestamps()[len(points)]
+	assert.Tf(t, !stamped.Before(before) && !stamped.After(time.Now()), "Push stamped the point with %v", stamped)
+
+	// though not without an interval
+	plain, err := NewAnomalyzer(&AnomalyzerConf{ActiveSize: 1, NSeasons: 4, Methods: []string{"magnitude"}}, nil)
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+	plain.Push(9)
+	assert.Equal(t, time.Time{}, plain.Timestamps()[0])
+
+	// trimming keeps enough points to fill the buckets the windows need,
+	// rather than that many points, with the last of them arriving now
+	start = time.Now().Add(-19 * 20 * time.Second)
+	for _, maxDataPoints := range []int{0, 5} {
+		conf := &AnomalyzerConf{ActiveSize: 1, NSeasons: 4, Interval: time.Minute, MaxDataPoints: maxDataPoints, Methods: []string{"magnitude"}}
+		anomalyzer, err := NewAnomalyzer(conf, nil)
+		assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+		for i := 0; i < 20; i++ {
+			anomalyzer.PushAt(start.Add(time.Duration(i)*20*time.Second), float64(i))
+		}
+		series := anomalyzer.series()
+		assert.Equal(t, 5, len(series))
+		assert.Equal(t, true, anomalyzer.Ready())
+
+		err = anomalyzer.Update([]float64{1})
+		assert.Equal(t, nil, err, "Error updating anomalyzer")
+		assert.Equal(t, true, anomalyzer.Ready())
+		assert.Equal(t, 5, len(anomalyzer.series()))
+	}
+}
+
+func TestLastProbability(t *testing.T) {
+	conf := &AnomalyzerConf{
+		Sensitivity: 0.1,
+		UpperBound:  5,
+		LowerBound:  0,
+		ActiveSize:  1,
+		NSeasons:    4,
+		Methods:     []string{"cdf", "fence", "magnitude"},
+	}
+
+	data := []float64{0.1, 2.05, 1.5, 2.5, 2.6, 2.55}
+	anomalyzer, err := NewAnomalyzer(conf, data)
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+
+	_, ok := anomalyzer.LastProbability()
+	assert.Equal(t, false, ok, "No probability should be cached before an Eval")
+
+	prob, _ := anomalyzer.Push(8.0)
+	last, ok := anomalyzer.LastProbability()
+	assert.Equal(t, true, ok, "Push should cache its probability")
+	assert.Equal(t, prob, last)
+
+	anomalyzer.Update([]float64{2.5})
+	_, ok = anomalyzer.LastProbability()
+	assert.Equal(t, false, ok, "Update should invalidate the cached probability")
+
+	prob = anomalyzer.Eval()
+	last, ok = anomalyzer.LastProbability()
+	assert.Equal(t, true, ok, "Eval should cache its probability")
+	assert.Equal(t, prob, last)
+
+	anomalyzer.Update([]float64{2.5})
+	prob, _ = anomalyzer.EvalDirection()
+	last, ok = anomalyzer.LastProbability()
+	assert.Equal(t, true, ok, "EvalDirection should cache its probability")
+	assert.Equal(t, prob, last)
+
+	// pushes without enough data to fill both windows have no probability
+	short, err := NewAnomalyzer(&AnomalyzerConf{ActiveSize: 1, NSeasons: 4, Methods: []string{"magnitude"}}, nil)
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+	short.Push(1)
+	_, ok = short.LastProbability()
+	assert.Equal(t, false, ok, "Push without enough data should not cache a probability")
+	short.PushBatch([]float64{2, 3}, false)
+	_, ok = short.LastProbability()
+	assert.Equal(t, false, ok, "PushBatch without enough data should not cache a probability")
+	short.PushBatch([]float64{4, 5}, true)
+	_, ok = short.LastProbability()
+	assert.Equal(t, true, ok, "PushBatch filling both windows should cache its probability")
+}
+
+func TestTrend(t *testing.T) {
+	noise := []float64{0.3, -0.2, 0.1, -0.4, 0.2, 0.0, -0.1, 0.4, -0.3, 0.1, -0.2}
+	conf := &AnomalyzerConf{
+		ActiveSize: 5,
+		NSeasons:   4,
+		Methods:    []string{"trend"},
+	}
+
+	flat := make([]float64, 0, 25)
+	ramp := make([]float64, 0, 25)
+	for i := 0; i < 25; i++ {
+		flat = append(flat, 10+noise[i%len(noise)])
+		if i < 20 {
+			ramp = append(ramp, 10+noise[i%len(noise)])
+		} else {
+			ramp = append(ramp, 10+0.5*float64(i-19)+noise[i%len(noise)])
+		}
+	}
+
+	anomalyzer, err := NewAnomalyzer(conf, ramp)
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+	prob := anomalyzer.EvalByMethod()["trend"]
+	assert.Tf(t, prob > 0.9, "Trend test missed a ramp (%f)", prob)
+
+	anomalyzer, err = NewAnomalyzer(conf, flat)
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+	prob = anomalyzer.EvalByMethod()["trend"]
+	assert.Tf(t, prob < 0.5, "Trend test fired on a flat series (%f)", prob)
+
+	// two points are too few to fit a line
+	conf = &AnomalyzerConf{
+		ActiveSize: 2,
+		NSeasons:   4,
+		Methods:    []string{"trend"},
+	}
+	anomalyzer, err = NewAnomalyzer(conf, []float64{1, 1, 1, 1, 1, 1, 1, 1, 1, 5, 50})
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+	assert.Equal(t, 0.0, anomalyzer.EvalByMethod()["trend"])
+}
+
+func TestClassify(t *testing.T) {
+	conf := &AnomalyzerConf{
+		Sensitivity: 0.1,
+		UpperBound:  5,
+		LowerBound:  0,
+		ActiveSize:  1,
+		NSeasons:    4,
+		Methods:     []string{"cdf", "fence", "magnitude"},
+	}
+
+	data := []float64{0.1, 2.05, 1.5, 2.5, 2.6, 2.55}
+	anomalyzer, err := NewAnomalyzer(conf, data)
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+
+	assert.Equal(t, SeverityNone, anomalyzer.Classify(0.5))
+	assert.Equal(t, SeverityWarning, anomalyzer.Classify(0.8))
+	assert.Equal(t, SeverityCritical, anomalyzer.Classify(0.99))
+
+	anomalyzer.Update([]float64{8.0})
+	assert.Equal(t, anomalyzer.Classify(anomalyzer.Eval()), anomalyzer.EvalSeverity())
+
+	_, err = NewAnomalyzer(&AnomalyzerConf{ActiveSize: 1, Methods: []string{"cdf"}, WarningThreshold: 0.9, CriticalThreshold: 0.85}, nil)
+	assert.NotEqual(t, nil, err, "Expected an error for inverted thresholds")
+}
+
+func TestReset(t *testing.T) {
+	newConf := func() *AnomalyzerConf {
+		return &AnomalyzerConf{
+			ActiveSize: 1,
+			NSeasons:   4,
+			PermCount:  50,
+			Seed:       3,
+			Methods:    []string{"cdf", "magnitude", "highrank"},
+		}
+	}
+
+	anomalyzer, err := NewAnomalyzer(newConf(), []float64{0.1, 2.05, 1.5, 2.5, 2.6, 2.55})
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+	anomalyzer.Push(8.0)
+
+	conf := anomalyzer.Conf
+	anomalyzer.Reset()
+	assert.Equal(t, 0, len(anomalyzer.Data))
+	assert.Equal(t, 0, len(anomalyzer.Timestamps()))
+	assert.Equal(t, conf, anomalyzer.Conf)
+	_, ok := anomalyzer.LastProbability()
+	assert.Equal(t, false, ok, "Reset should clear the cached probability")
+
+	fresh, err := NewAnomalyzer(newConf(), nil)
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+	for _, x := range []float64{1, 2, 1.5, 1.8, 1.2, 4} {
+		expected, _ := fresh.Push(x)
+		actual, _ := anomalyzer.Push(x)
+		assert.Equal(t, expected, actual, "Reset anomalyzer diverged from a fresh one")
+	}
+}
+
+func TestPushBatch(t *testing.T) {
+	newConf := func() *AnomalyzerConf {
+		return &AnomalyzerConf{
+			Sensitivity:   0.1,
+			UpperBound:    5,
+			LowerBound:    0,
+			ActiveSize:    1,
+			NSeasons:      4,
+			PermCount:     50,
+			Seed:          11,
+			MaxDataPoints: 8,
+			Methods:       []string{"cdf", "fence", "highrank", "magnitude"},
+		}
+	}
+	data := []float64{0.1, 2.05, 1.5}
+	batch := []float64{2.5, 2.6, 2.55, 2.4, 2.7, 8.0, 2.5, 2.45, 0.3}
+
+	single, err := NewAnomalyzer(newConf(), data)
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+	expected := make([]float64, len(batch))
+	for i, x := range batch {
+		expected[i], _ = single.Push(x)
+	}
+
+	batched, err := NewAnomalyzer(newConf(), data)
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+	probs, err := batched.PushBatch(batch, false)
+	assert.Equal(t, nil, err, "Error pushing batch")
+	assert.Equal(t, expected, probs)
+	assert.Equal(t, single.Data, batched.Data)
+
+	final, err := NewAnomalyzer(newConf(), data)
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+	probs, err = final.PushBatch(batch, true)
+	assert.Equal(t, nil, err, "Error pushing batch")
+	assert.Equal(t, 1, len(probs))
+	assert.Equal(t, single.Data, final.Data)
+
+	_, err = final.PushBatch([]float64{1, math.NaN()}, false)
+	assert.NotEqual(t, nil, err, "Expected an error pushing NaN")
+	assert.Equal(t, single.Data, final.Data)
+
+	// without permutations, which draw differently when only the final
+	// point is evaluated, the final probability matches the last push,
+	// including once the data is pinned at MaxDataPoints
+	deterministic := func() *AnomalyzerConf {
+		conf := newConf()
+		conf.MaxDataPoints = 5
+		conf.Methods = []string{"magnitude", "fence"}
+		return conf
+	}
+	single, err = NewAnomalyzer(deterministic(), []float64{1, 2, 3, 4, 5, 6, 7})
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+	final, err = NewAnomalyzer(deterministic(), []float64{1, 2, 3, 4, 5, 6, 7})
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+	for _, x := range []float64{1, 2, 3} {
+		single.Push(x)
+		final.Push(x)
+	}
+	for _, x := range batch {
+		expected[len(expected)-1], _ = single.Push(x)
+	}
+	probs, err = final.PushBatch(batch, true)
+	assert.Equal(t, nil, err, "Error pushing batch")
+	assert.Equal(t, expected[len(expected)-1], probs[0])
+	assert.Equal(t, single.Eval(), final.Eval())
+}
+
+func BenchmarkPushBatch(b *testing.B) {
+	walk, _ := randomWalk(1000, 0.5, 0.05)
+	conf := &AnomalyzerConf{
+		ActiveSize:    2,
+		NSeasons:      10,
+		MaxDataPoints: 100,
+		Methods:       []string{"cdf", "magnitude"},
+	}
+
+	b.Run("push", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			anomalyzer, _ := NewAnomalyzer(conf, nil)
+			for _, x := range walk {
+				anomalyzer.Push(x)
+			}
+		}
+	})
+	b.Run("batch", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			anomalyzer, _ := NewAnomalyzer(conf, nil)
+			anomalyzer.PushBatch(walk, false)
+		}
+	})
+}
+
+func BenchmarkPush(b *testing.B) {
+	walk, _ := randomWalk(1000, 0.5, 0.05)
+	conf := &AnomalyzerConf{
+		ActiveSize:    2,
+		NSeasons:      4,
+		MaxDataPoints: 100,
+		Seed:          1,
+		Methods:       []string{"magnitude", "cdf", "highrank", "lowrank", "diff", "ks"},
+	}
+	anomalyzer, err := NewAnomalyzer(conf, walk[:100])
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		anomalyzer.Push(walk[i%len(walk)])
+	}
+}
+
+func BenchmarkPushLargeReference(b *testing.B) {
+	walk, _ := randomWalk(5000, 0.5, 0.05)
+	conf := &AnomalyzerConf{
+		ActiveSize:    10,
+		ReferenceSize: 2000,
+		MaxDataPoints: 2010,
+		UpperBound:    1,
+		LowerBound:    0,
+		Methods:       []string{"magnitude", "fence", "cusum"},
+	}
+	anomalyzer, err := NewAnomalyzer(conf, walk[:2010])
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		anomalyzer.Push(walk[i%len(walk)])
+	}
+}
+
+func TestPushScratch(t *testing.T) {
+	walk, _ := randomWalk(200, 0.5, 0.05)
+	conf := &AnomalyzerConf{
+		ActiveSize: 2,
+		NSeasons:   4,
+		PermCount:  100,
+		Seed:       3,
+		Methods:    []string{"magnitude", "cdf", "highrank", "diff", "ks"},
+	}
+
+	// pushing reuses the scratch space from one point to the next, while
+	// evaluating does not, but both should yield the same probabilities
+	pushed, err := NewAnomalyzer(conf, nil)
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+	copied := *conf
+	evaluated, err := NewAnomalyzer(&copied, nil)
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+
+	// a reference window that has become all zeros has a mean of exactly
+	// zero with running statistics too, however it got there
+	walk = append(walk, 0.3, 0.1, 0.2, 0.4, 0.1, 0.3, 0, 0, 0, 0, 0, 0, 0, 0, 0.04, 0.05)
+	for _, x := range walk {
+		prob, err := pushed.Push(x)
+		assert.Equal(t, nil, err, "Error pushing value")
+
+		evaluated.Data.Push(x)
+		assert.Tf(t, math.Abs(prob-evaluated.Eval()) < 1e-12, "Push and Eval disagree after %v", x)
+	}
+}
+
+func TestInsufficientData(t *testing.T) {
+	conf := &AnomalyzerConf{
+		Sensitivity: 0.1,
+		UpperBound:  5,
+		LowerBound:  0,
+		ActiveSize:  2,
+		NSeasons:    4,
+		PermCount:   50,
+		Methods:     []string{"cdf", "diff", "fence", "highrank", "lowrank", "magnitude", "ks", "ewma", "trend"},
+	}
+
+	anomalyzer, err := NewAnomalyzer(conf, nil)
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+
+	// the windows need ActiveSize + NSeasons*ActiveSize points
+	assert.Equal(t, 10, anomalyzer.MinDataPoints())
+	for i := 0; i < anomalyzer.MinDataPoints()-1; i++ {
+		prob, err := anomalyzer.Push(float64(i%3) + 1)
+		assert.Equal(t, nil, err, "Error pushing data")
+		assert.Equal(t, 0.0, prob)
+		assert.Equal(t, 0, len(anomalyzer.EvalByMethod()))
+
+		_, err = anomalyzer.EvalContext(context.Background())
+		assert.Equal(t, ErrInsufficientData, err)
+	}
+
+	anomalyzer.Push(2)
+	_, err = anomalyzer.EvalContext(context.Background())
+	assert.Equal(t, nil, err, "Expected enough data once both windows are full")
+}
+
+func TestReferenceSize(t *testing.T) {
+	conf := &AnomalyzerConf{
+		ActiveSize:    2,
+		NSeasons:      4,
+		ReferenceSize: 5,
+		Methods:       []string{"magnitude"},
+	}
+
+	anomalyzer, err := NewAnomalyzer(conf, []float64{100, 100, 1, 2, 3, 4, 5, 6, 7})
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+
+	// the reference window is exactly the 5 points before the active window
+	reference, active, err := extractWindows(anomalyzer.Data, conf.referenceSize, conf.ActiveSize, 1)
+	assert.Equal(t, nil, err, "Error extracting windows")
+	assert.Equal(t, govector.Vector{1, 2, 3, 4, 5}, reference)
+	assert.Equal(t, govector.Vector{6, 7}, active)
+	assert.Equal(t, 7, anomalyzer.MinDataPoints())
+
+	_, err = NewAnomalyzer(&AnomalyzerConf{ActiveSize: 1, ReferenceSize: 3, Methods: []string{"cdf"}}, nil)
+	assert.NotEqual(t, nil, err, "Expected an error for a reference window that is too small")
+
+	_, err = NewAnomalyzer(&AnomalyzerConf{ActiveSize: 2, ReferenceSize: 10, MaxDataPoints: 11, Methods: []string{"cdf"}}, nil)
+	assert.NotEqual(t, nil, err, "Expected an error for windows that cannot fit in MaxDataPoints")
+
+	// ks would silently drop out when the reference does not split evenly
+	// into active windows
+	_, err = NewAnomalyzer(&AnomalyzerConf{ActiveSize: 3, ReferenceSize: 10}, nil)
+	assert.NotEqual(t, nil, err, "Expected an error for a reference window ks cannot split")
+
+	// and every method would drop out with a reference smaller than the
+	// active window
+	_, err = NewAnomalyzer(&AnomalyzerConf{ActiveSize: 5, ReferenceSize: 4, Methods: []string{"ks", "highrank", "cdf"}}, nil)
+	assert.NotEqual(t, nil, err, "Expected an error for a reference window smaller than the active window")
+
+	_, err = NewAnomalyzer(&AnomalyzerConf{ActiveSize: 3, ReferenceSize: 9}, nil)
+	assert.Equal(t, nil, err, "Expected a reference window of whole active windows to be accepted")
+}
+
+func TestRobustFence(t *testing.T) {
+	noise := []float64{0.3, -0.2, 0.1, -0.4, 0.2, 0.0, -0.1, 0.4, -0.3, 0.1}
+	clean := make(govector.Vector, 0, 21)
+	for i := 0; i < 20; i++ {
+		clean = append(clean, 10+noise[i%len(noise)])
+	}
+	dirty := append(govector.Vector{}, clean...)
+	dirty[3], dirty[11] = 60, -40
+
+	conf := &AnomalyzerConf{
+		ActiveSize: 1,
+		NSeasons:   20,
+		Methods:    []string{"robustfence"},
+	}
+	err := validateConf(conf)
+	assert.Equal(t, nil, err, "Error validating configuration")
+
+	// the same fence placed using the mean and standard deviation
+	meanFence := func(vector govector.Vector) float64 {
+		reference, active, _ := extractWindows(vector, conf.referenceSize, conf.ActiveSize, 1)
+		return fenceDistance(active.Mean(), reference.Mean(), reference.Sd())
+	}
+
+	// on clean data the two fences broadly agree that a jump is anomalous
+	clean = append(clean, 11.5)
+	robust, naive := RobustFenceTest(clean, *conf), meanFence(clean)
+	assert.Tf(t, robust > 0.8 && naive > 0.8, "Fences disagreed on clean data (%f, %f)", robust, naive)
+
+	// but a couple of outliers in the reference blow the mean fence open
+	dirty = append(dirty, 11.5)
+	robust, naive = RobustFenceTest(dirty, *conf), meanFence(dirty)
+	assert.Tf(t, robust > 0.8, "Robust fence was swayed by outliers (%f)", robust)
+	assert.Tf(t, naive < 0.1, "Mean fence unexpectedly ignored the outliers (%f)", naive)
+}
+
+func TestCusum(t *testing.T) {
+	// symmetric noise with a mean of zero
+	noise := govector.Vector{0.3, -0.2, 0.1, -0.4, 0.2, 0.0, -0.1, 0.4, -0.3, 0.0}
+	conf := &AnomalyzerConf{
+		Sensitivity:   0.1,
+		UpperBound:    20,
+		LowerBound:    0,
+		ActiveSize:    30,
+		ReferenceSize: 60,
+		Methods:       []string{"cusum", "magnitude", "fence"},
+	}
+
+	series := func(shift float64) []float64 {
+		data := make([]float64, 90)
+		for i := range data {
+			data[i] = 10 + noise[i%len(noise)]
+			if i >= 60 {
+				data[i] += shift
+			}
+		}
+		return data
+	}
+
+	// a persistent shift of half a standard deviation
+	anomalyzer, err := NewAnomalyzer(conf, series(0.5*noise.Sd()))
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+	probs := anomalyzer.EvalByMethod()
+	assert.Tf(t, probs["cusum"] > 0.8, "Cusum missed a persistent shift (%f)", probs["cusum"])
+	assert.Tf(t, probs["magnitude"] < conf.Sensitivity, "Magnitude unexpectedly noticed the shift (%f)", probs["magnitude"])
+	assert.Tf(t, probs["fence"] < 0.1, "Fence unexpectedly noticed the shift (%f)", probs["fence"])
+
+	anomalyzer, err = NewAnomalyzer(conf, series(0))
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+	probs = anomalyzer.EvalByMethod()
+	assert.Tf(t, probs["cusum"] < 0.5, "Cusum fired on symmetric noise (%f)", probs["cusum"])
+}
+
+func TestWindows(t *testing.T) {
+	conf := &AnomalyzerConf{
+		ActiveSize: 1,
+		NSeasons:   4,
+		Methods:    []string{"magnitude"},
+	}
+
+	anomalyzer, err := NewAnomalyzer(conf, []float64{1, 2, 3, 4, 5, 6, 7, 8, 9})
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+
+	// the example from the README
+	assert.Equal(t, govector.Vector{9}, anomalyzer.ActiveWindow())
+	assert.Equal(t, govector.Vector{5, 6, 7, 8}, anomalyzer.ReferenceWindow())
+
+	// the windows are copies
+	reference := anomalyzer.ReferenceWindow()
+	reference[0] = 100
+	assert.Equal(t, 5.0, anomalyzer.Data[4])
+}
+
+func TestAggregation(t *testing.T) {
+	conf := &AnomalyzerConf{
+		Sensitivity: 0.1,
+		UpperBound:  5,
+		LowerBound:  0,
+		ActiveSize:  1,
+		NSeasons:    4,
+		Methods:     []string{"cdf", "fence", "magnitude"},
+	}
+
+	data := []float64{0.1, 2.05, 1.5, 2.5, 2.6, 2.55, 4.0}
+	anomalyzer, err := NewAnomalyzer(conf, data)
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+	assert.Equal(t, "weighted", conf.Aggregation)
+
+	probs := anomalyzer.EvalByMethod()
+	values := govector.Vector{probs["cdf"], probs["fence"], probs["magnitude"]}
+
+	conf.Aggregation = "mean"
+	assert.Tf(t, math.Abs(anomalyzer.Eval()-values.Mean()) < 1e-12, "Expected the mean probability %f, got %f", values.Mean(), anomalyzer.Eval())
+
+	conf.Aggregation = "max"
+	assert.Equal(t, values.Max(), anomalyzer.Eval())
+
+	// the magnitude cutoff applies whatever the aggregation
+	conf.Sensitivity = probs["magnitude"] + 0.01
+	for _, aggregation := range []string{"weighted", "mean", "max"} {
+		conf.Aggregation = aggregation
+		prob := anomalyzer.Eval()
+		assert.Tf(t, prob == 0, "Expected the %s aggregation to respect Sensitivity, got %f", aggregation, prob)
+	}
+
+	_, err = NewAnomalyzer(&AnomalyzerConf{ActiveSize: 1, Methods: []string{"cdf"}, Aggregation: "median"}, nil)
+	assert.NotEqual(t, nil, err, "Expected an error for an unknown aggregation")
+}
+
+func TestWarmup(t *testing.T) {
+	conf := &AnomalyzerConf{
+		Sensitivity: 0.1,
+		UpperBound:  5,
+		LowerBound:  0,
+		ActiveSize:  1,
+		NSeasons:    4,
+		Warmup:      10,
+		Methods:     []string{"cdf", "fence", "magnitude"},
+	}
+
+	anomalyzer, err := NewAnomalyzer(conf, []float64{0.1, 2.05, 1.5, 2.5, 2.6, 2.55})
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+	assert.Equal(t, false, anomalyzer.Ready())
+
+	for _, x := range []float64{2.4, 2.7, 2.5} {
+		prob, _ := anomalyzer.Push(x)
+		assert.Equal(t, 0.0, prob)
+		assert.Equal(t, false, anomalyzer.Ready())
+	}
+
+	prob, _ := anomalyzer.Push(8.0)
+	assert.Equal(t, true, anomalyzer.Ready())
+	assert.Tf(t, prob > 0.5, "Anomalyzer returned a probability that was too small after warmup")
+
+	anomalyzer.Reset()
+	assert.Equal(t, false, anomalyzer.Ready())
+}
+
+func TestClone(t *testing.T) {
+	conf := &AnomalyzerConf{
+		Sensitivity: 0.1,
+		UpperBound:  5,
+		LowerBound:  0,
+		ActiveSize:  1,
+		NSeasons:    4,
+		PermCount:   50,
+		Seed:        9,
+		Weights:     map[string]float64{"cdf": 1},
+		Methods:     []string{"cdf", "fence", "highrank", "magnitude"},
+	}
+
+	original, err := NewAnomalyzer(conf, []float64{0.1, 2.05, 1.5, 2.5, 2.6, 2.55})
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+	before := copyVector(original.Data)
+
+	clone := original.Clone()
+	clone.Push(8.0)
+	clone.Conf.Methods[0] = "ks"
+	clone.Conf.Weights["cdf"] = 2
+
+	assert.Equal(t, before, original.Data)
+	assert.Equal(t, "cdf", original.Conf.Methods[0])
+	assert.Equal(t, 1.0, original.Conf.Weights["cdf"])
+
+	// clones draw from their own seeded source, so two clones of the
+	// same anomalyzer agree with each other
+	first, second := original.Clone(), original.Clone()
+	x, _ := first.Push(8.0)
+	y, _ := second.Push(8.0)
+	assert.Equal(t, x, y)
+}
+
+func TestEnableDisableMethod(t *testing.T) {
+	conf := &AnomalyzerConf{
+		Sensitivity: 0.1,
+		ActiveSize:  1,
+		NSeasons:    4,
+		Weights:     map[string]float64{"cdf": 2},
+		Methods:     []string{"cdf", "magnitude"},
+	}
+
+	anomalyzer, err := NewAnomalyzer(conf, []float64{0.1, 2.05, 1.5, 2.5, 2.6, 2.55})
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+
+	err = anomalyzer.EnableMethod("ewma")
+	assert.Equal(t, nil, err, "Error enabling method")
+	assert.Equal(t, []string{"cdf", "magnitude", "ewma"}, conf.Methods)
+	assert.Equal(t, 0.3, conf.EwmaDecay)
+	_, ok := anomalyzer.EvalByMethod()["ewma"]
+	assert.Tf(t, ok, "Enabled method was not evaluated")
+
+	assert.NotEqual(t, nil, anomalyzer.EnableMethod("bogus"), "Expected an error enabling an unknown method")
+	assert.NotEqual(t, nil, anomalyzer.EnableMethod("fence"), "Expected an error enabling fence without bounds")
+	assert.Equal(t, []string{"cdf", "magnitude", "ewma"}, conf.Methods)
+
+	err = anomalyzer.DisableMethod("cdf")
+	assert.Equal(t, nil, err, "Error disabling method")
+	assert.Equal(t, []string{"magnitude", "ewma"}, conf.Methods)
+	assert.Equal(t, map[string]float64{}, conf.Weights)
+	_, ok = anomalyzer.EvalByMethod()["cdf"]
+	assert.Tf(t, !ok, "Disabled method was still evaluated")
+
+	assert.NotEqual(t, nil, anomalyzer.DisableMethod("cdf"), "Expected an error disabling a method twice")
+	assert.Equal(t, nil, anomalyzer.DisableMethod("ewma"))
+	assert.NotEqual(t, nil, anomalyzer.DisableMethod("magnitude"), "Expected an error disabling every method")
+}
+
+func TestRankSum(t *testing.T) {
+	source := rand.New(rand.NewSource(1))
+	conf := &AnomalyzerConf{
+		ActiveSize: 20,
+		NSeasons:   2,
+		Methods:    []string{"ranksum"},
+	}
+	err := validateConf(conf)
+	assert.Equal(t, nil, err, "Error validating configuration")
+
+	sample := func(shift float64) govector.Vector {
+		data := make(govector.Vector, 60)
+		for i := range data {
+			data[i] = source.NormFloat64()
+			if i >= 40 {
+				data[i] += shift
+			}
+		}
+		return data
+	}
+
+	same := RankSumTest(sample(0), *conf)
+	assert.Tf(t, same < 0.8, "Rank sum fired on samples from the same distribution (%f)", same)
+
+	up, down := RankSumTest(sample(1.5), *conf), RankSumTest(sample(-1.5), *conf)
+	assert.Tf(t, up > 0.95, "Rank sum missed an upward shift (%f)", up)
+	assert.Tf(t, down > 0.95, "Rank sum missed a downward shift (%f)", down)
+
+	// ties share the mean of their ranks
+	ranks, ties := midranks(govector.Vector{3, 1, 3, 2, 3})
+	assert.Equal(t, govector.Vector{4, 1, 4, 2, 4}, ranks)
+	assert.Equal(t, 24.0, ties)
+
+	// with every value tied there is nothing to distinguish
+	assert.Equal(t, 0.0, RankSumTest(make(govector.Vector, 60), *conf))
+}
+
+func TestAnomalyHandler(t *testing.T) {
+	conf := &AnomalyzerConf{
+		Sensitivity: 0.1,
+		UpperBound:  5,
+		LowerBound:  0,
+		ActiveSize:  1,
+		NSeasons:    4,
+		Aggregation: "max",
+		Methods:     []string{"fence"},
+	}
+
+	anomalyzer, err := NewAnomalyzer(conf, []float64{2.45, 2.55, 2.5, 2.6, 2.4})
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+
+	// pushing with no handler is a no-op
+	anomalyzer.Push(4.99)
+
+	var values []float64
+	anomalyzer.SetAnomalyHandler(func(prob, value float64) {
+		assert.Tf(t, prob >= conf.Threshold, "Handler called below the threshold (%f)", prob)
+		values = append(values, value)
+
+		// the anomalyzer is unlocked while the handler runs
+		anomalyzer.Eval()
+	})
+
+	// still elevated from before the handler was set, so no crossing
+	anomalyzer.Push(4.98)
+	assert.Equal(t, 0, len(values))
+
+	for _, x := range []float64{2.5, 4.99, 4.95, 4.97, 2.5, 2.4} {
+		anomalyzer.Push(x)
+	}
+	anomalyzer.PushBatch([]float64{0.01, 0.02, 2.5, 0.01}, false)
+	assert.Equal(t, []float64{4.99, 0.01, 0.01}, values)
+
+	anomalyzer.SetAnomalyHandler(nil)
+	anomalyzer.Push(2.5)
+	anomalyzer.Push(4.99)
+	assert.Equal(t, 3, len(values))
+}
+
+func TestHysteresis(t *testing.T) {
+	conf := &AnomalyzerConf{
+		ActiveSize:     1,
+		NSeasons:       4,
+		Threshold:      0.8,
+		ExitThreshold:  0.6,
+		MinConsecutive: 2,
+		Methods:        []string{"magnitude"},
+	}
+
+	anomalyzer, err := NewAnomalyzer(conf, nil)
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+
+	transitions := 0
+	anomalyzer.SetAnomalyHandler(func(prob, value float64) { transitions++ })
+
+	// a probability oscillating around the threshold
+	probs := []float64{0.79, 0.81, 0.78, 0.82, 0.79, 0.83, 0.85, 0.79, 0.81, 0.7, 0.82, 0.65, 0.78, 0.59, 0.81, 0.78}
+	states := make([]AlertState, len(probs))
+	for i, prob := range probs {
+		anomalyzer.mu.Lock()
+		alerts := anomalyzer.observe(nil, prob, 0)
+		anomalyzer.mu.Unlock()
+		anomalyzer.notify(alerts)
+		states[i] = anomalyzer.State()
+	}
+
+	// anomalous only after two consecutive points above the threshold, and
+	// normal again only once the probability falls below the exit threshold
+	n, a := StateNormal, StateAnomalous
+	assert.Equal(t, []AlertState{n, n, n, n, n, n, a, a, a, a, a, a, a, n, n, n}, states)
+	assert.Equal(t, 1, transitions)
+
+	// without hysteresis the defaults leave the state following the threshold
+	conf = &AnomalyzerConf{ActiveSize: 1, NSeasons: 4, Methods: []string{"magnitude"}}
+	err = validateConf(conf)
+	assert.Equal(t, nil, err, "Error validating configuration")
+	assert.Equal(t, conf.Threshold, conf.ExitThreshold)
+	assert.Equal(t, 1, conf.MinConsecutive)
+}
+
+func TestMultiAnomalyzer(t *testing.T) {
+	conf := &AnomalyzerConf{
+		ActiveSize: 5,
+		NSeasons:   4,
+		Methods:    []string{"magnitude", "cdf"},
+	}
+	multi, err := NewMultiAnomalyzer(conf, 3)
+	assert.Equal(t, nil, err, "Error initializing new multivariate anomalyzer")
+	assert.Equal(t, 3, multi.Len())
+
+	// requests, cpu and latency all follow the same underlying load
+	rng := rand.New(rand.NewSource(1))
+	sample := func(load float64, broken bool) []float64 {
+		cpu := 2*load + 0.01*rng.NormFloat64()
+		if broken {
+			cpu = 2 - 2*load + 0.01*rng.NormFloat64()
+		}
+		return []float64{load, cpu, 10 + load + 0.01*rng.NormFloat64()}
+	}
+
+	joint := 0.0
+	for i := 0; i < 25; i++ {
+		probs, p, err := multi.Push(sample(0.5+0.3*math.Sin(float64(i)), false))
+		assert.Equal(t, nil, err, "Error pushing values")
+		assert.Equal(t, 3, len(probs))
+		joint = p
+	}
+	assert.Tf(t, joint < 0.9, "Correlated series yielded a joint probability of %v", joint)
+
+	// cpu now moves against the load, while each series on its own still
+	// looks much as it did
+	for i := 25; i < 30; i++ {
+		_, joint, err = multi.Push(sample(0.5+0.3*math.Sin(float64(i)), true))
+		assert.Equal(t, nil, err, "Error pushing values")
+	}
+	assert.Tf(t, joint > 0.99, "Broken correlation yielded a joint probability of %v", joint)
+
+	probs, p := multi.Eval()
+	assert.Equal(t, 3, len(probs))
+	assert.Equal(t, joint, p)
+
+	_, _, err = multi.Push([]float64{1, 2})
+	assert.NotEqual(t, nil, err, "Multivariate anomalyzer accepted the wrong number of values")
+	_, _, err = multi.Push([]float64{1, math.NaN(), 3})
+	assert.NotEqual(t, nil, err, "Multivariate anomalyzer accepted a NaN")
+
+	// each series can be tuned on its own
+	err = multi.Series(0).EnableMethod("ewma")
+	assert.Equal(t, nil, err, "Error enabling method on a series")
+	assert.Equal(t, []string{"magnitude", "cdf", "ewma"}, multi.Series(0).Conf.Methods)
+	assert.Equal(t, []string{"magnitude", "cdf"}, multi.Series(1).Conf.Methods)
+
+	_, err = NewMultiAnomalyzer(conf, 1)
+	assert.NotEqual(t, nil, err, "Multivariate anomalyzer accepted a single series")
+}
+
+func TestPushReader(t *testing.T) {
+	conf := &AnomalyzerConf{
+		ActiveSize:    1,
+		NSeasons:      4,
+		MaxDataPoints: 6,
+		Methods:       []string{"magnitude"},
+	}
+	anomalyzer, err := NewAnomalyzer(conf, nil)
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+
+	n, err := anomalyzer.PushReader(strings.NewReader("1.0\n2\n\n3.5 4\n5, 6,7\n  8\n"))
+	assert.Equal(t, nil, err, "Error pushing values from reader")
+	assert.Equal(t, 8, n)
+	assert.Equal(t, govector.Vector{3.5, 4, 5, 6, 7, 8}, anomalyzer.Data)
+
+	last, ok := anomalyzer.LastProbability()
+	assert.Tf(t, ok, "PushReader did not evaluate the probability")
+	assert.Equal(t, anomalyzer.Eval(), last)
+
+	// reading stops at the first bad value, after pushing those before it
+	anomalyzer.Reset()
+	n, err = anomalyzer.PushReader(strings.NewReader("1\n2\n3 x 4\n5\n"))
+	assert.NotEqual(t, nil, err, "PushReader accepted an invalid value")
+	assert.Tf(t, strings.Contains(err.Error(), "Line 3"), "Error %q does not give the line number", err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, govector.Vector{1, 2, 3}, anomalyzer.Data)
+
+	anomalyzer.Reset()
+	n, err = anomalyzer.PushReader(strings.NewReader("1\nNaN\n"))
+	assert.NotEqual(t, nil, err, "PushReader accepted a NaN")
+	assert.Tf(t, strings.Contains(err.Error(), "Line 2"), "Error %q does not give the line number", err)
+	assert.Equal(t, 1, n)
+
+	// a single row of CSV may be far longer than a line buffer
+	anomalyzer.Reset()
+	row := make([]string, 20000)
+	for i := range row {
+		row[i] = strconv.Itoa(i % 10)
+	}
+	observer := &recordingObserver{}
+	conf.Observer = observer
+	n, err = anomalyzer.PushReader(strings.NewReader(strings.Join(row, ",") + "\n"))
+	assert.Equal(t, nil, err, "Error pushing a long row")
+	assert.Equal(t, 20000, n)
+	assert.Equal(t, govector.Vector{4, 5, 6, 7, 8, 9}, anomalyzer.Data)
+
+	// and is evaluated once per batch rather than once per value
+	assert.Equal(t, (20000+readerBatch-1)/readerBatch, len(observer.durations))
+	conf.Observer = nil
+
+	anomalyzer.Reset()
+	_, err = anomalyzer.PushReader(strings.NewReader("1\n\n" + strings.Join(row, ",") + ",x\n"))
+	assert.Tf(t, err != nil && strings.Contains(err.Error(), "Line 3"), "Error %q does not give the line number", err)
+}
+
+func TestExplain(t *testing.T) {
+	conf := &AnomalyzerConf{
+		ActiveSize: 2,
+		NSeasons:   4,
+		Methods:    []string{"magnitude", "cdf", "robustfence"},
+	}
+	anomalyzer, err := NewAnomalyzer(conf, []float64{10, 11, 9, 10, 10, 11, 9, 10})
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+
+	_, err = anomalyzer.Explain()
+	assert.Equal(t, ErrInsufficientData, err)
+
+	anomalyzer.Push(10.5)
+	anomalyzer.Push(40)
+
+	explanation, err := anomalyzer.Explain()
+	assert.Equal(t, nil, err, "Error explaining evaluation")
+	assert.Equal(t, anomalyzer.Eval(), explanation.Probability)
+	assert.Equal(t, anomalyzer.EvalByMethod(), explanation.Methods)
+	assert.Equal(t, 25.25, explanation.ActiveMean)
+	assert.Equal(t, 10.0, explanation.ReferenceMean)
+
+	// the median of the reference window is 10 and its scaled MAD is
+	// 0.5 * 1.4826, so only the spike is outside the fences
+	assert.Tf(t, math.Abs(explanation.LowerFence-(10-1.5*1.4826)) < 1e-9, "Unexpected lower fence %v", explanation.LowerFence)
+	assert.Tf(t, math.Abs(explanation.UpperFence-(10+1.5*1.4826)) < 1e-9, "Unexpected upper fence %v", explanation.UpperFence)
+	assert.Equal(t, []Outlier{{1, 40}}, explanation.Outliers)
+
+	text := explanation.String()
+	assert.Tf(t, strings.Contains(text, "robustfence:"), "Explanation %q is missing the methods", text)
+	assert.Tf(t, strings.Contains(text, "point 1 of the active window (40)"), "Explanation %q is missing the outlier", text)
+
+	// with the fence test, points are judged against its bounds
+	fenced, err := NewAnomalyzer(&AnomalyzerConf{ActiveSize: 2, NSeasons: 4, UpperBound: 5, LowerBound: 0, Methods: []string{"fence"}}, []float64{2, 2.1, 1.9, 2, 2.1, 1.9, 2, 2.1, 2, 4.9})
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+	explanation, err = fenced.Explain()
+	assert.Equal(t, nil, err, "Error explaining evaluation")
+	assert.Equal(t, 0.0, explanation.LowerFence)
+	assert.Equal(t, 5.0, explanation.UpperFence)
+	assert.Equal(t, 0, len(explanation.Outliers))
+	assert.Tf(t, explanation.RobustUpperFence < 4.9, "Unexpected robust upper fence %v", explanation.RobustUpperFence)
+	assert.Tf(t, strings.Contains(explanation.String(), "robust fences:"), "Explanation %q is missing the robust fences", explanation.String())
+
+	fenced.Push(6)
+	fenced.Push(-1)
+	fenced.Conf.LowerBound = NA
+	explanation, err = fenced.Explain()
+	assert.Equal(t, nil, err, "Error explaining evaluation")
+	assert.Equal(t, NA, explanation.LowerFence)
+	assert.Equal(t, []Outlier{{0, 6}}, explanation.Outliers)
+
+	// and the means are weighted as the tests weight them
+	forgetful, err := NewAnomalyzer(&AnomalyzerConf{ActiveSize: 1, NSeasons: 4, ForgetFactor: 0.5, Methods: []string{"magnitude"}}, []float64{20, 10, 10, 10, 10, 10, 12})
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+	explanation, err = forgetful.Explain()
+	assert.Equal(t, nil, err, "Error explaining evaluation")
+	assert.Equal(t, 12.0, explanation.ActiveMean)
+	assert.Tf(t, math.Abs(explanation.ReferenceMean-(10+10.0/63)) < 1e-9, "Unexpected weighted reference mean %v", explanation.ReferenceMean)
+}
+
+func TestHalfLife(t *testing.T) {
+	// a calm reference window with a single shift in the baseline, either
+	// early on or just before an active window of larger moves
+	shifted := func(at int) govector.Vector {
+		vector := govector.Vector{}
+		level := 10.0
+		for i := 0; i < 16; i++ {
+			if i == at {
+				level++
+			}
+			vector = append(vector, level+0.1*float64(i%2))
+		}
+		return append(vector, level+0.6, level+0.1)
+	}
+	early, recent := shifted(2), shifted(14)
+
+	conf := AnomalyzerConf{ActiveSize: 2, NSeasons: 8, Methods: []string{"cdf"}}
+	err := validateConf(&conf)
+	assert.Equal(t, nil, err, "Error validating configuration")
+
+	// without a half-life the reference window is unordered
+	assert.Equal(t, CDFTest(early, conf), CDFTest(recent, conf))
+
+	// with one, the recent shift makes the active moves look more
+	// ordinary than the early one does
+	conf.HalfLife = 3
+	assert.Tf(t, CDFTest(early, conf) > CDFTest(recent, conf), "Early shift (%v) had no less influence than a recent one (%v)", CDFTest(early, conf), CDFTest(recent, conf))
+
+	conf.HalfLife = -1
+	err = validateConf(&conf)
+	assert.NotEqual(t, nil, err, "Negative half-life was accepted")
+}
+
+func TestSpike(t *testing.T) {
+	reference := govector.Vector{}
+	for i := 0; i < 20; i++ {
+		reference = append(reference, 10+0.5*math.Sin(float64(i)))
+	}
+	conf := AnomalyzerConf{ActiveSize: 5, NSeasons: 4, Methods: []string{"spike"}}
+	err := validateConf(&conf)
+	assert.Equal(t, nil, err, "Error validating configuration")
+
+	// a lone extreme reading stands out even though the window's mean
+	// barely moves
+	lone := append(append(govector.Vector{}, reference...), 10, 10.2, 16, 9.8, 10)
+	prob := SpikeTest(lone, conf)
+	assert.Tf(t, prob > 0.95, "Lone outlier yielded a probability of %v", prob)
+
+	// whereas a smoothly raised level is not a spike
+	elevated := append(append(govector.Vector{}, reference...), 14, 14.2, 14.1, 14.3, 14.2)
+	prob = SpikeTest(elevated, conf)
+	assert.Tf(t, prob < 0.1, "Smoothly elevated data yielded a probability of %v", prob)
+
+	// nor is a return to the reference level from a raised one
+	returning := append(append(govector.Vector{}, reference...), 14, 14.2, 14.1, 10, 10.1)
+	prob = SpikeTest(returning, conf)
+	assert.Tf(t, prob < 0.1, "Returning to the reference level yielded a probability of %v", prob)
+
+	anomalyzer, err := NewAnomalyzer(&AnomalyzerConf{ActiveSize: 5, NSeasons: 4, Methods: []string{"spike"}}, lone)
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+	assert.Tf(t, anomalyzer.Eval() > 0.95, "Spike method was not used by Eval")
+}
+
+func TestQuantile(t *testing.T) {
+	// a log-normal series, with a long upper tail
+	rng := rand.New(rand.NewSource(1))
+	lognormal := func() float64 {
+		return math.Exp(0.75 * rng.NormFloat64())
+	}
+	reference := govector.Vector{}
+	for i := 0; i < 80; i++ {
+		reference = append(reference, lognormal())
+	}
+
+	conf := AnomalyzerConf{ActiveSize: 4, ReferenceSize: 80, Methods: []string{"quantile"}}
+	err := validateConf(&conf)
+	assert.Equal(t, nil, err, "Error validating configuration")
+	assert.Equal(t, 0.01, conf.LowerQuantile)
+	assert.Equal(t, 0.99, conf.UpperQuantile)
+
+	// ordinary draws, including from the upper tail, stay within the
+	// bounds
+	typical := append(append(govector.Vector{}, reference...), 0.6, 1.1, 2.5, 3.5)
+	prob := QuantileTest(typical, conf)
+	assert.Tf(t, prob < 0.1, "Typical draws yielded a probability of %v", prob)
+
+	// and a value near zero is below the lower bound, which a symmetric
+	// fence would have placed below zero
+	mean, sd := reference.Mean(), reference.Sd()
+	assert.Tf(t, mean-3*sd < 0, "Symmetric fence did not reach below zero")
+	low := append(append(govector.Vector{}, reference...), 1, 1, 1, 0.01)
+	prob = QuantileTest(low, conf)
+	assert.Tf(t, prob > 0, "Value below the lower bound was not scored")
+
+	// while a window far beyond the upper tail is anomalous
+	extreme := append(append(govector.Vector{}, reference...), 15, 18, 20, 16)
+	prob = QuantileTest(extreme, conf)
+	assert.Tf(t, prob > 0.9, "Extreme draws yielded a probability of %v", prob)
+
+	conf.LowerQuantile, conf.UpperQuantile = 0.9, 0.1
+	err = validateConf(&conf)
+	assert.NotEqual(t, nil, err, "Decreasing quantiles were accepted")
+}
+
+func TestRunningStats(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	conf := &AnomalyzerConf{
+		ActiveSize:    3,
+		ReferenceSize: 12,
+		MaxDataPoints: 20,
+		UpperBound:    1000,
+		LowerBound:    0,
+		Methods:       []string{"magnitude", "fence", "cusum"},
+	}
+	anomalyzer, err := NewAnomalyzer(conf, nil)
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+
+	close := func(x, y float64) bool {
+		return math.Abs(x-y) <= 1e-9*math.Max(1, math.Abs(y))
+	}
+	incremental := false
+	for i := 0; i < 500; i++ {
+		x := 100 + 10*rng.NormFloat64()
+		if i%50 == 0 {
+			x += 1000
+		}
+		prob, err := anomalyzer.Push(x)
+		assert.Equal(t, nil, err, "Error pushing value")
+
+		assert.Tf(t, close(prob, anomalyzer.Eval()), "Push yielded %v but Eval %v", prob, anomalyzer.Eval())
+		if !anomalyzer.Ready() {
+			continue
+		}
+
+		// once the windows are full, the running statistics agree with
+		// computing them afresh
+		stats := anomalyzer.scratch.stats
+		incremental = incremental || stats.updates > 0
+		reference, active := anomalyzer.windows()
+		assert.Tf(t, close(stats.active.mean, active.Mean()), "Active mean %v, expected %v", stats.active.mean, active.Mean())
+		assert.Tf(t, close(stats.reference.mean, reference.Mean()), "Reference mean %v, expected %v", stats.reference.mean, reference.Mean())
+		assert.Tf(t, close(stats.reference.sd(), reference.Sd()), "Reference sd %v, expected %v", stats.reference.sd(), reference.Sd())
+	}
+
+	assert.Tf(t, incremental, "Running statistics were never updated incrementally")
+
+	// changing the data other than through Push recomputes the statistics
+	anomalyzer.Pop()
+	anomalyzer.Data[len(anomalyzer.Data)-1] = 1e6
+	anomalyzer.Update([]float64{50})
+	prob, _ := anomalyzer.Push(60)
+	assert.Tf(t, close(prob, anomalyzer.Eval()), "Push yielded %v but Eval %v after changing the data", prob, anomalyzer.Eval())
+}
+
+func TestExactKS(t *testing.T) {
+	// for equal sample sizes n, P(D >= k/n) is
+	// 2 * sum_j (-1)^(j+1) C(2n, n-jk) / C(2n, n)
+	choose := func(n, k int) float64 {
+		if k < 0 || k > n {
+			return 0
+		}
+		c := 1.0
+		for i := 1; i <= k; i++ {
+			c = c * float64(n-k+i) / float64(i)
+		}
+		return c
+	}
+	n := 10
+	for k := 1; k <= n; k++ {
+		tail, sign := 0.0, 1.0
+		for j := 1; n-j*k >= 0; j++ {
+			tail += sign * choose(2*n, n-j*k)
+			sign = -sign
+		}
+		tail = 2 * tail / choose(2*n, n)
+
+		got := 1 - ksCdf(float64(k)/float64(n), n, n)
+		assert.Tf(t, math.Abs(got-tail) < 1e-12, "P(D >= %d/%d) was %v, expected %v", k, n, got, tail)
+	}
+
+	// for unequal sizes, compare with every way of splitting the values
+	// 1..9 into samples of 3 and 6
+	var distances []float64
+	for mask := 0; mask < 1<<9; mask++ {
+		x, y := govector.Vector{}, govector.Vector{}
+		for v := 0; v < 9; v++ {
+			if mask&(1<<v) != 0 {
+				x = append(x, float64(v))
+			} else {
+				y = append(y, float64(v))
+			}
+		}
+		if len(x) == 3 {
+			distances = append(distances, ksDistance(x, y))
+		}
+	}
+	for _, d := range []float64{1.0 / 3, 0.5, 2.0 / 3, 5.0 / 6, 1} {
+		below := 0
+		for _, distance := range distances {
+			if distance < d-1e-9 {
+				below++
+			}
+		}
+		expected := float64(below) / float64(len(distances))
+		got := ksCdf(d, 3, 6)
+		assert.Tf(t, math.Abs(got-expected) < 1e-12, "P(D < %v) was %v, expected %v", d, got, expected)
+	}
+
+	// the critical values at the 5% level are 7/10 for two samples of 10
+	// and 5/5 for two samples of 5
+	assert.Tf(t, 1-ksCdf(0.7, 10, 10) < 0.05, "D = 0.7 should be significant for samples of 10")
+	assert.Tf(t, 1-ksCdf(0.6, 10, 10) > 0.05, "D = 0.6 should not be significant for samples of 10")
+	assert.Tf(t, 1-ksCdf(1, 5, 5) < 0.05, "D = 1 should be significant for samples of 5")
+	assert.Tf(t, 1-ksCdf(0.8, 5, 5) > 0.05, "D = 0.8 should not be significant for samples of 5")
+
+	// the exact test is stable from one evaluation to the next
+	walk, _ := randomWalk(50, 0.5, 0.05)
+	conf := &AnomalyzerConf{ActiveSize: 10, NSeasons: 4, ExactKS: true, Methods: []string{"ks"}}
+	anomalyzer, err := NewAnomalyzer(conf, walk)
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+	prob := anomalyzer.Eval()
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, prob, anomalyzer.Eval())
+	}
+	reference, active := anomalyzer.windows()
+	assert.Equal(t, ksCdf(ksDistance(active, reference), 10, 40), prob)
+
+	// while windows too large for it fall back to the permutations
+	walk, _ = randomWalk(1000, 0.5, 0.05)
+	exact := AnomalyzerConf{ActiveSize: 200, NSeasons: 4, PermCount: 50, Seed: 1, ExactKS: true, Methods: []string{"ks"}}
+	err = validateConf(&exact)
+	assert.Equal(t, nil, err, "Error validating configuration")
+	bootstrap := exact
+	bootstrap.ExactKS = false
+	exact.rand, _ = newRand(1)
+	bootstrap.rand, _ = newRand(1)
+	assert.Equal(t, BootstrapKsTest(walk, bootstrap), BootstrapKsTest(walk, exact))
+}
+
+func TestAutoTune(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	seasonal := func(n, period int) []float64 {
+		data := make([]float64, n)
+		for i := range data {
+			data[i] = 10 + math.Sin(2*math.Pi*float64(i)/float64(period)) + 0.1*rng.NormFloat64()
+		}
+		return data
+	}
+
+	// a series with several seasons of 12 points gets an active window of
+	// one season
+	conf := &AnomalyzerConf{ActiveSize: 1, Methods: []string{"magnitude", "ks"}}
+	anomalyzer, err := NewAnomalyzer(conf, seasonal(120, 12))
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+	err = anomalyzer.AutoTune()
+	assert.Equal(t, nil, err, "Error tuning anomalyzer")
+	assert.Equal(t, 12, conf.ActiveSize)
+	assert.Equal(t, 48, anomalyzer.MinDataPoints()-conf.ActiveSize)
+
+	// too short a series to see a season repeat falls back to the first
+	// zero crossing, roughly a quarter of the way through the season
+	conf = &AnomalyzerConf{ActiveSize: 1, Methods: []string{"magnitude"}}
+	anomalyzer, err = NewAnomalyzer(conf, seasonal(60, 40))
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+	err = anomalyzer.AutoTune()
+	assert.Equal(t, nil, err, "Error tuning anomalyzer")
+	assert.Tf(t, conf.ActiveSize >= 8 && conf.ActiveSize <= 12, "Active window of %d points, expected around 10", conf.ActiveSize)
+
+	// too little or flat data is refused, leaving the configuration alone
+	conf = &AnomalyzerConf{ActiveSize: 1, Methods: []string{"magnitude"}}
+	anomalyzer, err = NewAnomalyzer(conf, seasonal(10, 4))
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+	assert.NotEqual(t, nil, anomalyzer.AutoTune(), "AutoTune accepted too little data")
+	assert.Equal(t, 1, conf.ActiveSize)
+
+	anomalyzer, err = NewAnomalyzer(conf, make([]float64, 40))
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+	assert.NotEqual(t, nil, anomalyzer.AutoTune(), "AutoTune accepted a flat series")
+	assert.Equal(t, 1, conf.ActiveSize)
+}
+
+func TestCalibrate(t *testing.T) {
+	// ten outcomes at each of four scores, with the rate of real
+	// anomalies dipping at 0.4
+	var scores, labels []float64
+	for _, outcome := range []struct {
+		score     float64
+		anomalies int
+	}{{0.2, 2}, {0.4, 1}, {0.6, 5}, {0.8, 9}} {
+		for i := 0; i < 10; i++ {
+			scores = append(scores, outcome.score)
+			label := 0.0
+			if i < outcome.anomalies {
+				label = 1
+			}
+			labels = append(labels, label)
+		}
+	}
+
+	conf := &AnomalyzerConf{ActiveSize: 1, NSeasons: 4, Methods: []string{"magnitude", "cdf"}}
+	anomalyzer, err := NewAnomalyzer(conf, []float64{1, 2, 1, 2, 1, 1.9})
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+	err = anomalyzer.Calibrate(scores, labels)
+	assert.Equal(t, nil, err, "Error calibrating anomalyzer")
+
+	// the dip is pooled away, and scores between or beyond those seen
+	// are interpolated or held
+	c := anomalyzer.calibration
+	for _, expected := range []struct{ score, prob float64 }{
+		{0, 0.15}, {0.2, 0.15}, {0.4, 0.15}, {0.5, 0.325}, {0.6, 0.5}, {0.7, 0.7}, {0.8, 0.9}, {1, 0.9},
+	} {
+		prob := c.apply(expected.score)
+		assert.Tf(t, math.Abs(prob-expected.prob) < 1e-12, "Calibrated %v to %v, expected %v", expected.score, prob, expected.prob)
+	}
+
+	// Eval returns the calibrated probability
+	raw := anomalyzer.combine(anomalyzer.EvalByMethod(), nil)
+	assert.Equal(t, c.apply(raw), anomalyzer.Eval())
+
+	// and the calibration survives a round trip through JSON
+	b, err := json.Marshal(&anomalyzer)
+	assert.Equal(t, nil, err, "Error marshalling anomalyzer")
+	var restored Anomalyzer
+	err = json.Unmarshal(b, &restored)
+	assert.Equal(t, nil, err, "Error unmarshalling anomalyzer")
+	assert.Equal(t, anomalyzer.Eval(), restored.Eval())
+
+	err = anomalyzer.Calibrate([]float64{0.5}, []float64{1, 0})
+	assert.NotEqual(t, nil, err, "Calibrate accepted mismatched scores and labels")
+	err = anomalyzer.Calibrate([]float64{0.5}, []float64{0.5})
+	assert.NotEqual(t, nil, err, "Calibrate accepted a label that is not 0 or 1")
+
+	err = anomalyzer.Calibrate(nil, nil)
+	assert.Equal(t, nil, err, "Error removing calibration")
+	assert.Equal(t, raw, anomalyzer.Eval())
+}
+
+// A method that is always close to certain, whatever the data.
+type saturatedMethod struct{}
+
+func (saturatedMethod) Name() string { return "saturated" }
+
+func (saturatedMethod) Run(active, reference govector.Vector, conf *AnomalyzerConf) float64 {
+	return 0.99
+}
+
+// A method whose probability is the last value of the data.
+type lastValueMethod struct{}
+
+func (lastValueMethod) Name() string { return "lastvalue" }
+
+func (lastValueMethod) Run(active, reference govector.Vector, conf *AnomalyzerConf) float64 {
+	return active[len(active)-1]
+}
+
+func init() {
+	for _, method := range []Method{saturatedMethod{}, lastValueMethod{}} {
+		if err := RegisterMethod(method); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func TestNormalizeMethods(t *testing.T) {
+	// a quiet series with some jitter, followed by a spike
+	data := []float64{}
+	for i := 0; i < 31; i++ {
+		data = append(data, 0.1+0.01*float64(i%3))
+	}
+	spike := 0.9
+
+	probs := func(normalize bool) (float64, float64) {
+		conf := &AnomalyzerConf{
+			ActiveSize:       1,
+			NSeasons:         4,
+			Aggregation:      "max",
+			NormalizeMethods: normalize,
+			Methods:          []string{"saturated", "lastvalue"},
+		}
+		anomalyzer, err := NewAnomalyzer(conf, nil)
+		assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+
+		quiet := 0.0
+		for _, x := range data {
+			quiet, _ = anomalyzer.Push(x)
+		}
+		spiked, _ := anomalyzer.Push(spike)
+		return quiet, spiked
+	}
+
+	// the saturated method swamps the spike
+	quiet, spiked := probs(false)
+	assert.Equal(t, 0.99, quiet)
+	assert.Equal(t, 0.99, spiked)
+
+	// until each method is judged against its own history
+	quiet, spiked = probs(true)
+	assert.Tf(t, quiet < 0.5, "Quiet data yielded a normalized probability of %v", quiet)
+	assert.Tf(t, spiked > 0.99, "Spike yielded a normalized probability of %v", spiked)
+}
+
+func TestSeasonalReference(t *testing.T) {
+	// hourly data with a daily cycle, quiet overnight and ramping up to a
+	// busier day each morning
+	daily := func(hour int) float64 {
+		switch {
+		case hour < 6 || hour >= 20:
+			return 10
+		case hour < 10:
+			return 10 + 10*float64(hour-5)
+		default:
+			return 50
+		}
+	}
+	data := []float64{}
+	for day := 0; day < 5; day++ {
+		for hour := 0; hour < 24; hour++ {
+			data = append(data, daily(hour)+float64((day*7+hour*3)%5)*0.2)
+		}
+	}
+
+	// the highest probability over the morning ramp of the last day
+	ramp := func(seasonal bool) float64 {
+		conf := &AnomalyzerConf{
+			ActiveSize:        2,
+			NSeasons:          4,
+			SeasonalReference: seasonal,
+			SeasonLength:      24,
+			Seed:              1,
+			Methods:           []string{"magnitude", "ks", "quantile"},
+		}
+		anomalyzer, err := NewAnomalyzer(conf, nil)
+		assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+
+		highest := 0.0
+		for i, x := range data {
+			prob, _ := anomalyzer.Push(x)
+			if hour := i % 24; i >= 4*24 && hour >= 6 && hour < 10 {
+				highest = math.Max(highest, prob)
+			}
+		}
+		return highest
+	}
+
+	// against the preceding night the ramp looks anomalous, but not
+	// against the same hours of the previous days
+	prob := ramp(false)
+	assert.Tf(t, prob >= 0.8, "Morning ramp against the preceding points yielded %v", prob)
+	prob = ramp(true)
+	assert.Tf(t, prob < 0.8, "Morning ramp against previous mornings yielded %v", prob)
+
+	conf := &AnomalyzerConf{ActiveSize: 2, NSeasons: 4, SeasonalReference: true, SeasonLength: 24}
+	anomalyzer, err := NewAnomalyzer(conf, nil)
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+	assert.Equal(t, 2+4*24, anomalyzer.MinDataPoints())
+	for _, x := range data {
+		anomalyzer.Push(x)
+	}
+	n := len(data)
+	reference := govector.Vector{}
+	for season := 4; season > 0; season-- {
+		end := n - season*24
+		reference = append(reference, data[end-2:end]...)
+	}
+	assert.Equal(t, reference, anomalyzer.ReferenceWindow())
+	assert.Equal(t, govector.Vector(data[n-2:]), anomalyzer.ActiveWindow())
+
+	_, err = NewAnomalyzer(&AnomalyzerConf{ActiveSize: 2, NSeasons: 4, SeasonalReference: true, SeasonLength: 1}, nil)
+	assert.NotEqual(t, nil, err, "SeasonLength shorter than the active window should fail")
+	_, err = NewAnomalyzer(&AnomalyzerConf{ActiveSize: 2, NSeasons: 4, SeasonalReference: true, SeasonLength: 24, ReferenceSize: 8}, nil)
+	assert.NotEqual(t, nil, err, "ReferenceSize with SeasonalReference should fail")
+}
+
+func TestLevelShift(t *testing.T) {
+	baseline := func(i int) float64 {
+		return 10 + 0.5*math.Sin(float64(i))
+	}
+	step, spike := govector.Vector{}, govector.Vector{}
+	for i := 0; i < 40; i++ {
+		x := baseline(i)
+		spike = append(spike, x)
+		if i >= 30 {
+			x += 5
+		}
+		step = append(step, x)
+	}
+	spike[30] = 16
+
+	conf := AnomalyzerConf{ActiveSize: 3, NSeasons: 4, Methods: []string{"levelshift", "spike"}}
+	err := validateConf(&conf)
+	assert.Equal(t, nil, err, "Error validating configuration")
+
+	// a step to a new level keeps the levelshift method high for as long
+	// as the step is within the windows, whereas the spike method only
+	// fires at the transition
+	for n := 32; n <= 40; n++ {
+		prob := LevelShiftTest(step[:n], conf)
+		assert.Tf(t, prob > 0.8, "Level shift %d points back yielded a probability of %v", n-30, prob)
+		prob = SpikeTest(step[:n], conf)
+		assert.Tf(t, prob < 0.2, "Spike method %d points after a level shift yielded %v", n-30, prob)
+	}
+	prob := SpikeTest(step[:31], conf)
+	assert.Tf(t, prob > 0.95, "Spike method at a level shift yielded %v", prob)
+
+	// while a lone spike is caught by the spike method but is not a level
+	// shift
+	for n := 31; n <= 40; n++ {
+		prob := LevelShiftTest(spike[:n], conf)
+		assert.Tf(t, prob < 0.8, "Spike %d points back yielded a level shift probability of %v", n-31, prob)
+		if n < 34 {
+			prob = SpikeTest(spike[:n], conf)
+			assert.Tf(t, prob > 0.95, "Spike %d points back yielded a probability of %v", n-31, prob)
+		}
+	}
+
+	anomalyzer, err := NewAnomalyzer(&AnomalyzerConf{ActiveSize: 3, NSeasons: 4, Methods: []string{"levelshift"}}, step[:36])
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+	assert.Tf(t, anomalyzer.Eval() > 0.95, "Levelshift method was not used by Eval")
+}
+
+// Records what it observes, for TestObserver.
+type recordingObserver struct {
+	mu        sync.Mutex
+	durations []time.Duration
+	results   map[string][]float64
+}
+
+func (o *recordingObserver) ObserveEvalDuration(d time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.durations = append(o.durations, d)
+}
+
+func (o *recordingObserver) ObserveMethodResult(name string, prob float64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.results == nil {
+		o.results = map[string][]float64{}
+	}
+	o.results[name] = append(o.results[name], prob)
+}
+
+func TestObserver(t *testing.T) {
+	observer := &recordingObserver{}
+	conf := &AnomalyzerConf{
+		ActiveSize: 1,
+		NSeasons:   4,
+		Methods:    []string{"magnitude", "trend"},
+		Observer:   observer,
+	}
+	anomalyzer, err := NewAnomalyzer(conf, nil)
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+
+	// nothing is observed until there is enough data to evaluate
+	data := []float64{1, 2, 1, 2, 1, 5, 2}
+	for _, x := range data[:4] {
+		anomalyzer.Push(x)
+	}
+	assert.Equal(t, 0, len(observer.durations))
+
+	for _, x := range data[4:] {
+		anomalyzer.Push(x)
+	}
+	anomalyzer.Eval()
+	assert.Equal(t, 4, len(observer.durations))
+
+	// every method result is passed on, including the trend test's, which
+	// is always 0 for an active window of 1 point
+	assert.Equal(t, 4, len(observer.results["magnitude"]))
+	assert.Equal(t, []float64{0, 0, 0, 0}, observer.results["trend"])
+
+	// the observer is not serialized, and does not stop the state being
+	// restored over an anomalyzer that has one
+	b, err := json.Marshal(&anomalyzer)
+	assert.Equal(t, nil, err, "Error marshalling anomalyzer")
+	assert.Tf(t, !strings.Contains(string(b), "Observer"), "Observer was serialized: %s", b)
+
+	other, err := NewAnomalyzer(&AnomalyzerConf{ActiveSize: 1, NSeasons: 4, Methods: []string{"magnitude", "trend"}, Observer: observer}, nil)
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+	err = json.Unmarshal(b, &other)
+	assert.Equal(t, nil, err, "Error restoring over an anomalyzer with an observer")
+	assert.Equal(t, anomalyzer.Eval(), other.Eval())
+	assert.Equal(t, Observer(observer), other.Conf.Observer)
+}
+
+func TestEvalWithInterval(t *testing.T) {
+	data := []float64{2.1, 1.9, 2.3, 2.0, 1.8, 2.2, 2.0, 1.9, 2.4, 3.2, 3.6}
+
+	anomalyzer, err := NewAnomalyzer(&AnomalyzerConf{ActiveSize: 2, NSeasons: 4, Methods: []string{"magnitude", "cdf"}}, data[:5])
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+	prob, lower, upper := anomalyzer.EvalWithInterval()
+	assert.Equal(t, []float64{0, 0, 0}, []float64{prob, lower, upper})
+
+	// deterministic methods leave no room for doubt
+	for _, x := range data[5:] {
+		anomalyzer.Push(x)
+	}
+	prob, lower, upper = anomalyzer.EvalWithInterval()
+	assert.Equal(t, anomalyzer.Eval(), prob)
+	assert.Equal(t, prob, lower)
+	assert.Equal(t, prob, upper)
+
+	// whereas permutation tests are uncertain, less so with more
+	// permutations
+	width := func(conf *AnomalyzerConf) float64 {
+		anomalyzer, err := NewAnomalyzer(conf, data)
+		assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+		prob, lower, upper := anomalyzer.EvalWithInterval()
+		assert.Tf(t, lower <= prob && prob <= upper, "Probability %v was outside its interval [%v, %v]", prob, lower, upper)
+		return upper - lower
+	}
+	few := width(&AnomalyzerConf{ActiveSize: 2, NSeasons: 4, Methods: []string{"magnitude", "ks"}, PermCount: 100, Seed: 1})
+	many := width(&AnomalyzerConf{ActiveSize: 2, NSeasons: 4, Methods: []string{"magnitude", "ks"}, PermCount: 10000, Seed: 1})
+	assert.Tf(t, few > 0, "Permutation test yielded an interval of no width")
+	assert.Tf(t, many < few/5, "Raising PermCount narrowed the interval from %v only to %v", few, many)
+
+	// unless the ks distribution is computed exactly
+	exact := width(&AnomalyzerConf{ActiveSize: 2, NSeasons: 4, Methods: []string{"magnitude", "ks"}, ExactKS: true})
+	assert.Equal(t, 0.0, exact)
+
+	// the bounds of a proportion of 0 still leave room above it
+	lower, upper = wilsonInterval(0, 100)
+	assert.Equal(t, 0.0, lower)
+	assert.Tf(t, math.Abs(upper-0.037) < 0.001, "Wilson interval for 0 of 100 reached %v", upper)
+}
+
+func TestForgetFactor(t *testing.T) {
+	// a burst, followed by a long quiet spell that eventually pushes it
+	// out of the reference window
+	data := []float64{}
+	for i := 0; i < 40; i++ {
+		x := 10 + 0.2*math.Sin(float64(i))
+		if i >= 5 && i < 10 {
+			x = 20
+		}
+		data = append(data, x)
+	}
+
+	// the largest change in the magnitude test's probability from one push
+	// to the next, once the burst has left the active window
+	jump := func(conf *AnomalyzerConf) float64 {
+		anomalyzer, err := NewAnomalyzer(conf, nil)
+		assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+
+		largest, last := 0.0, 0.0
+		for i, x := range data {
+			anomalyzer.Push(x)
+			prob := anomalyzer.EvalByMethod()["magnitude"]
+			if i > 10 {
+				largest = math.Max(largest, math.Abs(prob-last))
+			}
+			last = prob
+		}
+		return largest
+	}
+
+	// the burst falling off the edge of a hard window makes the
+	// probability lurch, whereas it fades out with age
+	hard := jump(&AnomalyzerConf{ActiveSize: 1, NSeasons: 8, Methods: []string{"magnitude"}, MaxDataPoints: 9})
+	decayed := jump(&AnomalyzerConf{ActiveSize: 1, NSeasons: 8, Methods: []string{"magnitude"}, ForgetFactor: 0.9})
+	assert.Tf(t, decayed < hard/2, "Forgetting changed the probability by up to %v, against %v for a hard window", decayed, hard)
+
+	// points are dropped once their weight is negligible
+	conf := &AnomalyzerConf{ActiveSize: 1, NSeasons: 8, Methods: []string{"magnitude", "fence", "cdf"}, UpperBound: 30, LowerBound: NA, ForgetFactor: 0.9}
+	anomalyzer, err := NewAnomalyzer(conf, nil)
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+	for i := 0; i < 3; i++ {
+		for _, x := range data {
+			anomalyzer.Push(x)
+		}
+	}
+	assert.Equal(t, 44, len(anomalyzer.Data))
+	assert.Tf(t, math.Pow(0.9, 43) >= 0.01 && math.Pow(0.9, 44) < 0.01, "Kept points of negligible weight")
+	probs := anomalyzer.EvalByMethod()
+	assert.Equal(t, 3, len(probs))
+
+	// the windows reported are those the weighted tests use
+	assert.Equal(t, govector.Vector(anomalyzer.Data[:43]), anomalyzer.ReferenceWindow())
+	assert.Equal(t, govector.Vector(anomalyzer.Data[43:]), anomalyzer.ActiveWindow())
+
+	_, err = NewAnomalyzer(&AnomalyzerConf{ActiveSize: 1, NSeasons: 8, ForgetFactor: 1}, nil)
+	assert.NotEqual(t, nil, err, "ForgetFactor of 1 should fail")
+	_, err = NewAnomalyzer(&AnomalyzerConf{ActiveSize: 1, NSeasons: 8, ForgetFactor: 0.3}, nil)
+	assert.NotEqual(t, nil, err, "ForgetFactor that keeps too few points should fail")
+}
@@ -0,0 +1,95 @@
+package anomalyzer
+
+import (
+	"fmt"
+
+	"github.com/drewlanenga/govector"
+)
+
+// The fewest points AutoTune will estimate the window sizes from.
+const minAutoTunePoints = 20
+
+// The autocorrelation a peak must reach for AutoTune to take its lag as
+// the length of a season.
+const seasonalCorrelation = 0.5
+
+// Estimate ActiveSize from the autocorrelation of the data and update the
+// configuration with it.  The autocorrelation is computed for lags up to
+// half the length of the data.  If, after first falling to zero, it rises
+// to a peak of at least 0.5, the series is taken to be seasonal and the
+// active window is set to the lag of the highest such peak, so that it
+// spans one season and the reference window spans NSeasons of them.
+// Otherwise the active window is set to the lag at which the
+// autocorrelation first falls to zero, which is roughly how long the series
+// takes to forget where it was.
+//
+// An error is returned, and the configuration left unchanged, if there are
+// fewer than 20 points, if the series is flat or never decorrelates, or if
+// the configuration is not valid with the new active window.
+func (a *Anomalyzer) AutoTune() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	series := a.sampled()
+	if len(series) < minAutoTunePoints {
+		return fmt.Errorf("AutoTune needs at least %d points, but there are only %d", minAutoTunePoints, len(series))
+	}
+
+	acf := autocorrelation(series, len(series)/2)
+	if acf == nil {
+		return fmt.Errorf("AutoTune cannot estimate the window sizes of a flat series")
+	}
+
+	crossing := 0
+	for lag := 1; lag < len(acf); lag++ {
+		if acf[lag] <= 0 {
+			crossing = lag
+			break
+		}
+	}
+	if crossing == 0 {
+		return fmt.Errorf("Autocorrelation of the series never falls to zero, so AutoTune cannot estimate the window sizes")
+	}
+
+	size := crossing
+	peak := seasonalCorrelation
+	for lag := crossing + 1; lag < len(acf); lag++ {
+		if acf[lag] >= peak {
+			size, peak = lag, acf[lag]
+		}
+	}
+
+	conf := copyConf(a.Conf)
+	conf.ActiveSize = size
+	if err := validateConf(conf); err != nil {
+		return err
+	}
+	*a.Conf = *conf
+	a.setLast(0, false)
+	a.scratch.stats.valid = false
+	return nil
+}
+
+// Return the autocorrelation of the vector at lags 0 through maxLag, or nil
+// if the vector is flat.
+func autocorrelation(vector govector.Vector, maxLag int) []float64 {
+	mean := vector.Mean()
+
+	variance := 0.0
+	for _, x := range vector {
+		variance += (x - mean) * (x - mean)
+	}
+	if variance == 0 {
+		return nil
+	}
+
+	acf := make([]float64, maxLag+1)
+	for lag := range acf {
+		sum := 0.0
+		for t := 0; t+lag < len(vector); t++ {
+			sum += (vector[t] - mean) * (vector[t+lag] - mean)
+		}
+		acf[lag] = sum / variance
+	}
+	return acf
+}
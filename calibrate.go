@@ -0,0 +1,124 @@
+package anomalyzer
+
+import (
+	"fmt"
+	"sort"
+)
+
+// A monotonic mapping from combined probabilities to calibrated ones,
+// interpolated linearly between the points and held constant beyond them.
+type calibration struct {
+	Scores []float64
+	Probs  []float64
+}
+
+// Fit a mapping from the probabilities Eval returns to the rate at which
+// they turn out to be real anomalies, and apply it to every probability the
+// anomalyzer returns from then on, including those compared against the
+// thresholds.  Each score is a probability returned by Eval and its label
+// is 1 if it was a real anomaly or 0 if not.  The mapping is fit by
+// isotonic regression, so it never lowers the calibrated probability of a
+// higher score.
+//
+// Calling Calibrate with no scores removes the calibration.  An error is
+// returned, and the calibration left unchanged, if the scores and labels
+// differ in length, a score is not between 0 and 1, or a label is neither 0
+// nor 1.
+func (a *Anomalyzer) Calibrate(scores, labels []float64) error {
+	if len(scores) != len(labels) {
+		return fmt.Errorf("Expected a label for each of the %d scores, but got %d", len(scores), len(labels))
+	}
+	for i, score := range scores {
+		if !(score >= 0 && score <= 1) {
+			return fmt.Errorf("Score %v must be between 0 and 1", score)
+		}
+		if labels[i] != 0 && labels[i] != 1 {
+			return fmt.Errorf("Label %v must be 0 or 1", labels[i])
+		}
+	}
+
+	var c *calibration
+	if len(scores) > 0 {
+		c = fitIsotonic(scores, labels)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.calibration = c
+	a.setLast(0, false)
+	return nil
+}
+
+// Apply the calibration, if any, to a combined probability.  Expects the
+// caller to hold the lock.
+func (a *Anomalyzer) calibrate(prob float64) float64 {
+	if a.calibration == nil {
+		return prob
+	}
+	return a.calibration.apply(prob)
+}
+
+func (c *calibration) apply(score float64) float64 {
+	n := len(c.Scores)
+	i := sort.SearchFloat64s(c.Scores, score)
+	switch {
+	case i == 0:
+		return c.Probs[0]
+	case i == n:
+		return c.Probs[n-1]
+	}
+
+	lo, hi := c.Scores[i-1], c.Scores[i]
+	t := (score - lo) / (hi - lo)
+	return c.Probs[i-1] + t*(c.Probs[i]-c.Probs[i-1])
+}
+
+// Fit a non-decreasing step function to the labels by the pool adjacent
+// violators algorithm, returning the ends of each step.
+func fitIsotonic(scores, labels []float64) *calibration {
+	order := make([]int, len(scores))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return scores[order[i]] < scores[order[j]] })
+
+	// each block pools the labels of consecutive scores, starting with
+	// one block for each distinct score
+	type block struct {
+		lo, hi float64
+		sum    float64
+		count  float64
+	}
+	var blocks []block
+	for _, i := range order {
+		if n := len(blocks); n > 0 && blocks[n-1].hi == scores[i] {
+			blocks[n-1].sum += labels[i]
+			blocks[n-1].count++
+		} else {
+			blocks = append(blocks, block{scores[i], scores[i], labels[i], 1})
+		}
+
+		// merge the newest block into its predecessor for as long as
+		// the rate would otherwise decrease
+		for n := len(blocks); n > 1 && blocks[n-2].sum/blocks[n-2].count >= blocks[n-1].sum/blocks[n-1].count; n-- {
+			last := blocks[n-1]
+			blocks = blocks[:n-1]
+			blocks[n-2].hi = last.hi
+			blocks[n-2].sum += last.sum
+			blocks[n-2].count += last.count
+		}
+	}
+
+	c := &calibration{}
+	for _, b := range blocks {
+		rate := b.sum / b.count
+		c.Scores = append(c.Scores, b.lo)
+		c.Probs = append(c.Probs, rate)
+		if b.hi > b.lo {
+			c.Scores = append(c.Scores, b.hi)
+			c.Probs = append(c.Probs, rate)
+		}
+	}
+	return c
+}
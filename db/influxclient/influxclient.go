@@ -127,7 +127,7 @@ func (c *InfluxAnomalyClient) validateAnomalyzer() error {
 // Get data from InfluxDB.
 func (c *InfluxAnomalyClient) Get() ([]float64, error) {
 	// the number of elements we want to grab
-	sampleSize := (1 + c.Anomalyzer.Conf.NSeasons) * c.Anomalyzer.Conf.ActiveSize
+	sampleSize := c.Anomalyzer.MinDataPoints()
 
 	// this query selects the most recent data points over the past day
 	// using a "where" avoids scanning the whole set of data
@@ -174,7 +174,9 @@ func (c *InfluxAnomalyClient) Get() ([]float64, error) {
 // Update the underlying data in the anomalyzer with the new slice
 func (c *InfluxAnomalyClient) Update(data []float64) error {
 	// push in new data
-	c.Anomalyzer.Update(data)
+	if err := c.Anomalyzer.Update(data); err != nil {
+		return err
+	}
 	c.updated = time.Now()
 	return nil
 }
@@ -185,8 +187,7 @@ func (c *InfluxAnomalyClient) GetAndUpdate() error {
 		return err
 	}
 
-	c.Update(data)
-	return nil
+	return c.Update(data)
 }
 
 // Eval returns the probability that behavior in the active window is anomalous.
@@ -0,0 +1,147 @@
+package anomalyzer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/drewlanenga/govector"
+)
+
+// The serialized form of an Anomalyzer.
+type anomalyzerState struct {
+	Conf        *AnomalyzerConf
+	Data        govector.Vector
+	Times       []time.Time  `json:",omitempty"`
+	Seen        int          `json:",omitempty"`
+	Calibration *calibration `json:",omitempty"`
+
+	// the state of the random source when Conf.Seed is set
+	RandState *uint64 `json:",omitempty"`
+}
+
+// MarshalJSON serializes the configuration, the accumulated data, any
+// calibration and, when Conf.Seed is set, the state of the random source, so
+// that an anomalyzer can be persisted and later resumed with UnmarshalJSON,
+// drawing the same permutations it would have drawn had it carried on.
+// It has a pointer receiver, like the other methods, so callers must pass
+// json.Marshal a *Anomalyzer; given an Anomalyzer value, json falls back to
+// its default encoding, which leaves out the times, calibration and random
+// state.
+func (a *Anomalyzer) MarshalJSON() ([]byte, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	state := anomalyzerState{Conf: a.Conf, Data: a.Data, Times: a.alignedTimes(), Seen: a.seen, Calibration: a.calibration}
+	if a.source != nil {
+		randState := a.source.getState()
+		state.RandState = &randState
+	}
+	return json.Marshal(state)
+}
+
+// UnmarshalJSON restores the state written by MarshalJSON.  If the
+// anomalyzer already has a configuration, the restored configuration must
+// match it, otherwise an error is returned and the anomalyzer is left
+// untouched.
+func (a *Anomalyzer) UnmarshalJSON(b []byte) error {
+	var state anomalyzerState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return err
+	}
+	if state.Conf == nil {
+		return fmt.Errorf("Serialized anomalyzer is missing its configuration")
+	}
+	if err := validateConf(state.Conf); err != nil {
+		return err
+	}
+	for _, val := range state.Data {
+		if err := checkFinite(val); err != nil {
+			return err
+		}
+	}
+	if c := state.Calibration; c != nil {
+		if len(c.Scores) == 0 || len(c.Scores) != len(c.Probs) || !sort.Float64sAreSorted(c.Scores) {
+			return fmt.Errorf("Serialized calibration is malformed")
+		}
+	}
+
+	// an anomalyzer being decoded into afresh has no locks yet, and no
+	// one else can be holding it
+	if a.locks == nil {
+		a.locks = &locks{}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.Conf == nil {
+		a.Conf = state.Conf
+		a.rand, a.source = newRand(a.Conf.Seed)
+	} else {
+		// the observer is not serialized, so is kept rather than compared
+		if fields := confDiff(*state.Conf, *a.Conf); len(fields) > 0 {
+			return fmt.Errorf("Serialized configuration does not match the current configuration in %s", strings.Join(fields, ", "))
+		}
+	}
+
+	if state.Data == nil {
+		state.Data = govector.Vector{}
+	}
+	a.Data = state.Data
+	a.times = state.Times
+	a.times = a.alignedTimes()
+	a.seen = max(state.Seen, len(a.Data))
+	a.calibration = state.Calibration
+	if a.source != nil && state.RandState != nil {
+		a.source.setState(*state.RandState)
+	}
+	if size := a.Conf.maxDataPoints(); size > 0 {
+		a.trim(size)
+	}
+	a.history = nil
+	a.setLast(0, false)
+	a.scratch.stats.valid = false
+
+	return nil
+}
+
+// LoadConf decodes a configuration from a JSON object whose keys are the
+// names of the AnomalyzerConf fields, such as {"ActiveSize": 2, "Methods":
+// ["magnitude", "ks"]}.  Omitted fields take the same defaults as
+// NewAnomalyzer applies, and Interval is given in nanoseconds.  An error is
+// returned if the object has fields AnomalyzerConf does not, so that typos
+// are caught, or if the configuration is not valid.
+func LoadConf(r io.Reader) (*AnomalyzerConf, error) {
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+
+	conf := &AnomalyzerConf{}
+	if err := decoder.Decode(conf); err != nil {
+		return nil, fmt.Errorf("Error decoding configuration: %v", err)
+	}
+	if err := validateConf(conf); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// Return the names of the serialized fields of the configurations that
+// differ, in the order they are declared.
+func confDiff(x, y AnomalyzerConf) []string {
+	var fields []string
+	xv, yv := reflect.ValueOf(x), reflect.ValueOf(y)
+	for i := 0; i < xv.NumField(); i++ {
+		field := xv.Type().Field(i)
+		if field.PkgPath != "" || field.Tag.Get("json") == "-" {
+			continue
+		}
+		if !reflect.DeepEqual(xv.Field(i).Interface(), yv.Field(i).Interface()) {
+			fields = append(fields, field.Name)
+		}
+	}
+	return fields
+}
@@ -0,0 +1,124 @@
+package anomalyzer
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A breakdown of an evaluation, for explaining an anomaly to a person.
+type Explanation struct {
+	// the combined probability, after any calibration, and the
+	// probability from each method
+	Probability float64
+	Methods     map[string]float64
+
+	// the means of the active and reference windows, weighted as the
+	// tests weight them when HalfLife or ForgetFactor is set
+	ActiveMean    float64
+	ReferenceMean float64
+
+	// the fences the points of the active window are judged against, and
+	// the points outside them.  When the fence test is configured these
+	// are its LowerBound and UpperBound, with LowerFence NA if there is
+	// no lower bound, and otherwise they are the robust fences.
+	LowerFence float64
+	UpperFence float64
+	Outliers   []Outlier
+
+	// the fences the robust fence test places around the reference
+	// window, at its median plus or minus 3 scaled median absolute
+	// deviations
+	RobustLowerFence float64
+	RobustUpperFence float64
+}
+
+// A point of the active window that fell outside the fences.
+type Outlier struct {
+	// the position of the point within the active window, and its value
+	Index int
+	Value float64
+}
+
+// Evaluate the anomalous probability, as Eval does, and return it along
+// with the values that went into it.  ErrInsufficientData is returned until
+// there is enough data to fill both windows.
+func (a *Anomalyzer) Explain() (Explanation, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	probmap, err := a.evalByMethodContext(context.Background(), nil, nil)
+	if err != nil {
+		return Explanation{}, err
+	}
+	prob := a.calibrate(a.combine(probmap, nil))
+	a.setLast(prob, true)
+
+	// the robust fence test keeps its usual windows under ForgetFactor
+	reference, active, _ := extractWindows(a.series(), a.Conf.referenceSize, a.Conf.ActiveSize, -1)
+	center := median(reference)
+	spread := 3 * mad(reference, center)
+
+	explanation := Explanation{
+		Probability:      prob,
+		Methods:          probmap,
+		ActiveMean:       active.Mean(),
+		ReferenceMean:    reference.Mean(),
+		LowerFence:       center - spread,
+		UpperFence:       center + spread,
+		RobustLowerFence: center - spread,
+		RobustUpperFence: center + spread,
+	}
+	switch {
+	case a.Conf.ForgetFactor > 0:
+		reference, active, refWeights, activeWeights := forgetWindows(a.series(), *a.Conf)
+		explanation.ReferenceMean, _ = reference.WeightedMean(refWeights)
+		explanation.ActiveMean, _ = active.WeightedMean(activeWeights)
+	case a.Conf.HalfLife > 0:
+		explanation.ReferenceMean, _ = reference.WeightedMean(recencyWeights(len(reference), a.Conf.HalfLife))
+	}
+	if exists("fence", a.Conf.Methods) {
+		explanation.LowerFence, explanation.UpperFence = a.Conf.LowerBound, a.Conf.UpperBound
+	}
+
+	for i, x := range active {
+		if (explanation.LowerFence != NA && x < explanation.LowerFence) || x > explanation.UpperFence {
+			explanation.Outliers = append(explanation.Outliers, Outlier{i, x})
+		}
+	}
+	return explanation, nil
+}
+
+// Format the explanation as a few lines of text, suitable for an alert
+// annotation.
+func (e Explanation) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "probability: %.3f\n", e.Probability)
+
+	methods := make([]string, 0, len(e.Methods))
+	for method := range e.Methods {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	for _, method := range methods {
+		fmt.Fprintf(&b, "  %s: %.3f\n", method, e.Methods[method])
+	}
+
+	fmt.Fprintf(&b, "active mean: %g, reference mean: %g\n", e.ActiveMean, e.ReferenceMean)
+	if e.LowerFence == NA {
+		fmt.Fprintf(&b, "fences: below %g\n", e.UpperFence)
+	} else {
+		fmt.Fprintf(&b, "fences: [%g, %g]\n", e.LowerFence, e.UpperFence)
+	}
+	if e.LowerFence != e.RobustLowerFence || e.UpperFence != e.RobustUpperFence {
+		fmt.Fprintf(&b, "robust fences: [%g, %g]\n", e.RobustLowerFence, e.RobustUpperFence)
+	}
+	if len(e.Outliers) == 0 {
+		b.WriteString("no points outside the fences\n")
+	}
+	for _, outlier := range e.Outliers {
+		fmt.Fprintf(&b, "point %d of the active window (%g) is outside the fences\n", outlier.Index, outlier.Value)
+	}
+	return b.String()
+}
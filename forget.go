@@ -0,0 +1,32 @@
+package anomalyzer
+
+import (
+	"math"
+
+	"github.com/drewlanenga/govector"
+)
+
+// The weight below which ForgetFactor drops a point.
+const forgetWeight = 0.01
+
+// The number of points that carry a weight of at least forgetWeight under
+// ForgetFactor.
+func (conf *AnomalyzerConf) forgetSize() int {
+	return int(math.Log(forgetWeight)/math.Log(conf.ForgetFactor)) + 1
+}
+
+// Split the vector into the windows used when ForgetFactor is set: the
+// active window, and as the reference window every point before it.  Each
+// point is weighted by ForgetFactor raised to the number of points it lies
+// back from the newest, and the weights of both windows are returned along
+// with them.
+func forgetWindows(vector govector.Vector, conf AnomalyzerConf) (reference, active, refWeights, activeWeights govector.Vector) {
+	n := len(vector)
+	weights := make(govector.Vector, n)
+	for i := range weights {
+		weights[i] = math.Pow(conf.ForgetFactor, float64(n-1-i))
+	}
+
+	split := n - min(conf.ActiveSize, n)
+	return vector[:split], vector[split:], weights[:split], weights[split:]
+}
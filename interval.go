@@ -0,0 +1,67 @@
+package anomalyzer
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// The z-score of the 95% intervals reported by EvalWithInterval.
+const intervalZ = 1.96
+
+// Like Eval, but also returns a 95% interval around the probability that
+// reflects how much it could vary from one evaluation to the next.  The
+// methods estimated by permuting the windows, highrank, lowrank, diff and
+// ks, each have their probability bounded by the Wilson score interval for
+// the fraction of their PermCount permutations it was estimated from, and
+// the bounds of the methods are combined and calibrated just as their
+// probabilities are.  The other methods, and the ks test when ExactKS
+// computes its distribution exactly, are deterministic and contribute no
+// width, so the interval collapses to the probability when every method is.
+// The interval can be narrowed by raising PermCount.
+//
+// All three values are 0 until there is enough data to fill both windows.
+func (a *Anomalyzer) EvalWithInterval() (prob, lower, upper float64) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	var start time.Time
+	if a.Conf.Observer != nil {
+		start = time.Now()
+	}
+
+	permutations := map[string]int{}
+	probmap, err := a.evalByMethodContext(context.Background(), nil, permutations)
+	if err != nil {
+		return 0, 0, 0
+	}
+
+	lowers := make(map[string]float64, len(probmap))
+	uppers := make(map[string]float64, len(probmap))
+	for method, p := range probmap {
+		lowers[method], uppers[method] = p, p
+		if n, ok := permutations[method]; ok {
+			lowers[method], uppers[method] = wilsonInterval(p, n)
+		}
+	}
+
+	prob = a.calibrate(a.combine(probmap, nil))
+	lower = math.Min(prob, a.calibrate(a.combine(lowers, nil)))
+	upper = math.Max(prob, a.calibrate(a.combine(uppers, nil)))
+	a.setLast(prob, true)
+
+	if a.Conf.Observer != nil {
+		a.Conf.Observer.ObserveEvalDuration(time.Since(start))
+	}
+	return prob, lower, upper
+}
+
+// Return the Wilson score interval for a proportion p observed over n
+// trials, which unlike the normal approximation does not collapse when p is
+// 0 or 1.
+func wilsonInterval(p float64, n int) (float64, float64) {
+	z2n := intervalZ * intervalZ / float64(n)
+	center := (p + z2n/2) / (1 + z2n)
+	half := intervalZ / (1 + z2n) * math.Sqrt(p*(1-p)/float64(n)+z2n/(4*float64(n)))
+	return cap(center-half, 0, 1), cap(center+half, 0, 1)
+}
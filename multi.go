@@ -0,0 +1,176 @@
+package anomalyzer
+
+import (
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/drewlanenga/govector"
+)
+
+// A MultiAnomalyzer follows several series that are pushed together, such
+// as metrics that normally move in step.  Each series is scored by its own
+// anomalyzer, and the series are also scored jointly on whether their
+// correlation in the active window departs from their correlation in the
+// reference window, which no single series can reveal.
+type MultiAnomalyzer struct {
+	// guards the anomalyzers so that every series is pushed to together
+	mu     sync.RWMutex
+	series []*Anomalyzer
+}
+
+// Create a multivariate anomalyzer over n series.  Each series is given its
+// own copy of the configuration, so that changes to one, such as through
+// EnableMethod, do not affect the others.
+func NewMultiAnomalyzer(conf *AnomalyzerConf, n int) (*MultiAnomalyzer, error) {
+	if n < 2 {
+		return nil, fmt.Errorf("Multivariate anomalyzer needs at least 2 series, not %d", n)
+	}
+	if err := validateConf(conf); err != nil {
+		return nil, err
+	}
+
+	m := &MultiAnomalyzer{series: make([]*Anomalyzer, n)}
+	for i := range m.series {
+		anomalyzer, err := NewAnomalyzer(copyConf(conf), nil)
+		if err != nil {
+			return nil, err
+		}
+		m.series[i] = &anomalyzer
+	}
+	return m, nil
+}
+
+// Return the number of series.
+func (m *MultiAnomalyzer) Len() int {
+	return len(m.series)
+}
+
+// Return the anomalyzer scoring the i-th series, for instance to change
+// its methods with EnableMethod or to inspect its windows.  Points should
+// still be added through the MultiAnomalyzer, since pushing to a single
+// series puts it out of step with the others.  Series panics if i is out of
+// range.
+func (m *MultiAnomalyzer) Series(i int) *Anomalyzer {
+	return m.series[i]
+}
+
+// Add a point to each series, with xs holding one value per series, and
+// return the updated probability of each series along with the joint
+// probability that the correlation between the series has broken down.
+// If xs has the wrong length or any of its values is NaN or infinite, an
+// error is returned and none of the values are added.
+func (m *MultiAnomalyzer) Push(xs []float64) ([]float64, float64, error) {
+	if len(xs) != len(m.series) {
+		return nil, 0, fmt.Errorf("Expected %d values, one per series, but got %d", len(m.series), len(xs))
+	}
+	for _, x := range xs {
+		if err := checkFinite(x); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	probs := make([]float64, len(xs))
+	for i, x := range xs {
+		probs[i], _ = m.series[i].Push(x)
+	}
+	return probs, m.joint(), nil
+}
+
+// Return the probability of each series along with the joint probability
+// that the correlation between the series has broken down.
+func (m *MultiAnomalyzer) Eval() ([]float64, float64) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	probs := make([]float64, len(m.series))
+	for i, anomalyzer := range m.series {
+		probs[i] = anomalyzer.Eval()
+	}
+	return probs, m.joint()
+}
+
+// Return the joint probability of the series, and expects the caller to
+// hold the lock.  It is 0 until there is enough data to fill both windows.
+func (m *MultiAnomalyzer) joint() float64 {
+	references := make([]govector.Vector, len(m.series))
+	actives := make([]govector.Vector, len(m.series))
+	for i, anomalyzer := range m.series {
+		if !anomalyzer.Ready() {
+			return 0
+		}
+		references[i], actives[i] = anomalyzer.ReferenceWindow(), anomalyzer.ActiveWindow()
+	}
+	return CorrelationTest(references, actives)
+}
+
+// Compares the correlation of every pair of series over the active window
+// to their correlations over every active-sized run of the reference
+// window.  The distance from the typical reference correlation is measured
+// in standard deviations of the reference correlations and mapped to a
+// probability between 0 and 1, and the largest probability of any pair is
+// returned.  Pairs whose correlation is undefined, because a window is flat,
+// are ignored, as are active windows of fewer than 3 points, which are too
+// short to yield a meaningful correlation.
+func CorrelationTest(references, actives []govector.Vector) float64 {
+	prob := 0.0
+	for i := range actives {
+		for j := i + 1; j < len(actives); j++ {
+			prob = math.Max(prob, pairCorrelationTest(references[i], references[j], actives[i], actives[j]))
+		}
+	}
+	return prob
+}
+
+func pairCorrelationTest(refX, refY, activeX, activeY govector.Vector) float64 {
+	size := len(activeX)
+	if size < 3 || len(activeY) != size || len(refX) != len(refY) {
+		return 0
+	}
+
+	active := correlation(activeX, activeY)
+	if math.IsNaN(active) {
+		return 0
+	}
+
+	refCorrs := govector.Vector{}
+	for k := 0; k+size <= len(refX); k++ {
+		if r := correlation(refX[k:k+size], refY[k:k+size]); !math.IsNaN(r) {
+			refCorrs = append(refCorrs, r)
+		}
+	}
+	if len(refCorrs) < 2 {
+		return 0
+	}
+
+	distance := math.Abs(active - refCorrs.Mean())
+	sd := refCorrs.Sd()
+	if sd == 0 {
+		if distance == 0 {
+			return 0
+		}
+		return 1
+	}
+	return math.Erf(distance / sd / math.Sqrt2)
+}
+
+// Return the Pearson correlation of two vectors of the same length, or NaN
+// if either of them is flat.
+func correlation(x, y govector.Vector) float64 {
+	xMean, yMean := x.Mean(), y.Mean()
+
+	cov, xVar, yVar := 0.0, 0.0, 0.0
+	for i := range x {
+		dx, dy := x[i]-xMean, y[i]-yMean
+		cov += dx * dy
+		xVar += dx * dx
+		yVar += dy * dy
+	}
+	if xVar == 0 || yVar == 0 {
+		return math.NaN()
+	}
+	return cov / math.Sqrt(xVar*yVar)
+}
@@ -0,0 +1,59 @@
+package anomalyzer
+
+import (
+	"math"
+
+	"github.com/drewlanenga/govector"
+)
+
+// The number of recent probabilities of each method kept for
+// NormalizeMethods, and the fewest it normalizes against.
+const (
+	methodHistory    = 20
+	minMethodHistory = 5
+)
+
+// Return the probability of a method normalized against its recent
+// probabilities if Conf.NormalizeMethods is set.  A probability at or below
+// the method's recent mean scores 0, and one above it is measured in
+// standard deviations of the recent probabilities and mapped to a
+// probability between 0 and 1.  Until a method has enough history, its
+// probability is returned as is.  Expects the caller to hold the lock.
+func (a *Anomalyzer) normalize(method string, prob float64) float64 {
+	if !a.Conf.NormalizeMethods {
+		return prob
+	}
+	history := a.history[method]
+	if len(history) < minMethodHistory {
+		return prob
+	}
+
+	// compare a flat history directly, since rounding can leave its mean
+	// and standard deviation a hair away from the value itself
+	if history.Max() == history.Min() {
+		if prob > history[0] {
+			return 1
+		}
+		return 0
+	}
+
+	distance := prob - history.Mean()
+	if distance <= 0 {
+		return 0
+	}
+	return math.Erf(distance / history.Sd() / math.Sqrt2)
+}
+
+// Add the probabilities of the methods to their histories, dropping the
+// oldest once a history is full.  Expects the caller to hold the write lock.
+func (a *Anomalyzer) record(probmap map[string]float64) {
+	if !a.Conf.NormalizeMethods {
+		return
+	}
+	if a.history == nil {
+		a.history = make(map[string]govector.Vector, len(probmap))
+	}
+	for method, prob := range probmap {
+		a.history[method] = truncate(append(a.history[method], prob), methodHistory)
+	}
+}
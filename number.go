@@ -0,0 +1,19 @@
+//go:build go1.18
+
+package anomalyzer
+
+// The numeric types PushNumber accepts, including named types such as
+// time.Duration whose underlying type is one of them.
+type Number interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr |
+		~float32 | ~float64
+}
+
+// Convert x to a float64 and push it onto the anomalyzer, as Push does, so
+// that counters and durations can be pushed without a conversion at every
+// call site.  Integers beyond 2^53 in magnitude lose precision in the
+// conversion.
+func PushNumber[T Number](a *Anomalyzer, x T) (float64, error) {
+	return a.Push(float64(x))
+}
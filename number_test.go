@@ -0,0 +1,30 @@
+//go:build go1.18
+
+package anomalyzer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	"github.com/drewlanenga/govector"
+)
+
+func TestPushNumber(t *testing.T) {
+	conf := &AnomalyzerConf{
+		ActiveSize: 1,
+		NSeasons:   4,
+		Methods:    []string{"magnitude"},
+	}
+	anomalyzer, err := NewAnomalyzer(conf, nil)
+	assert.Equal(t, nil, err, "Error initializing new anomalyzer")
+
+	PushNumber(&anomalyzer, int64(3))
+	PushNumber(&anomalyzer, uint8(4))
+	PushNumber(&anomalyzer, float32(0.5))
+	PushNumber(&anomalyzer, 250*time.Millisecond)
+	prob, err := PushNumber(&anomalyzer, 7)
+	assert.Equal(t, nil, err, "Error pushing number")
+	assert.Equal(t, govector.Vector{3, 4, 0.5, 2.5e8, 7}, anomalyzer.Data)
+	assert.Equal(t, anomalyzer.Eval(), prob)
+}
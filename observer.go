@@ -0,0 +1,25 @@
+package anomalyzer
+
+import (
+	"time"
+)
+
+// An Observer is told how evaluations went, so that anomalyzers can be
+// monitored without this package depending on a metrics library.  Set one
+// as AnomalyzerConf.Observer.
+//
+// ObserveMethodResult is called with the value each method returned,
+// before it is capped to between 0 and 1, whenever the methods are run,
+// including by EvalByMethod.  A degenerate result, such as NA or NaN,
+// is passed on even though it is left out of the combined probability.
+// ObserveEvalDuration is called with the time each Eval, EvalContext,
+// EvalWithInterval or Push took to compute its probability, and is not
+// called when there is not yet enough data or the context is cancelled.
+//
+// Both are called while the anomalyzer is locked, possibly from several
+// goroutines at once, so they must be safe for concurrent use and must not
+// call back into the anomalyzer.
+type Observer interface {
+	ObserveEvalDuration(d time.Duration)
+	ObserveMethodResult(name string, prob float64)
+}
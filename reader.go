@@ -0,0 +1,90 @@
+package anomalyzer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The number of values PushReader reads before pushing them as a batch.
+const readerBatch = 1024
+
+// Read floats separated by whitespace, newlines or commas from r and push
+// them, returning the number pushed.  This suits files with one value per
+// line as well as single rows or columns of CSV, however long.  The values
+// are pushed in batches with PushBatch, evaluating only after the last of
+// each batch, so backfilling a long history does not run every test once
+// per value; the anomaly handler only hears of the probability after each
+// batch.  Reading stops at the first value that cannot be parsed or is not
+// a finite number, with an error giving its line number; the values before
+// it have already been pushed.
+func (a *Anomalyzer) PushReader(r io.Reader) (int, error) {
+	// split on the separators themselves rather than on lines, so that a
+	// long row is read a value at a time, counting the lines as they end
+	line := 1
+	scanner := bufio.NewScanner(r)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		start := 0
+		for start < len(data) {
+			c, width := utf8.DecodeRune(data[start:])
+			if !isSeparator(c) {
+				break
+			}
+			if c == '\n' {
+				line++
+			}
+			start += width
+		}
+
+		for i := start; i < len(data); {
+			c, width := utf8.DecodeRune(data[i:])
+			if isSeparator(c) {
+				return i, data[start:i], nil
+			}
+			i += width
+		}
+		if atEOF && len(data) > start {
+			return len(data), data[start:], nil
+		}
+		return start, nil, nil
+	})
+
+	count := 0
+	batch := make([]float64, 0, readerBatch)
+	flush := func() {
+		if len(batch) > 0 {
+			// the values are known to be finite, so this cannot fail
+			a.PushBatch(batch, true)
+			count += len(batch)
+			batch = batch[:0]
+		}
+	}
+	for scanner.Scan() {
+		field := scanner.Text()
+		x, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			flush()
+			return count, fmt.Errorf("Line %d: invalid value %q", line, field)
+		}
+		if err := checkFinite(x); err != nil {
+			flush()
+			return count, fmt.Errorf("Line %d: %v", line, err)
+		}
+		if batch = append(batch, x); len(batch) == readerBatch {
+			flush()
+		}
+	}
+	flush()
+	if err := scanner.Err(); err != nil {
+		return count, err
+	}
+	return count, nil
+}
+
+// Reports whether c separates the values read by PushReader.
+func isSeparator(c rune) bool {
+	return c == ',' || unicode.IsSpace(c)
+}
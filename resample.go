@@ -0,0 +1,163 @@
+package anomalyzer
+
+import (
+	"time"
+
+	"github.com/drewlanenga/govector"
+)
+
+// Like Push, but records the time at which the point was observed.  The
+// timestamps are only used when Conf.Interval is set, in which case the
+// series is resampled to evenly spaced buckets before the tests are run.
+// Points added by Push, PushBatch or Update are then stamped with the time
+// they were added, and the zero time given here is treated the same way.
+// Points passed to NewAnomalyzer have no timestamp, so they are averaged
+// into a single bucket ahead of the rest.
+//
+// Points are never reordered.  A timestamp earlier than the one before it
+// is treated as if the point had arrived at the same time as its
+// predecessor, and so lands in the same bucket.
+func (a *Anomalyzer) PushAt(t time.Time, x float64) (float64, error) {
+	return a.push(t, x)
+}
+
+// Return a copy of the timestamps of the points in Data.  Points added
+// without a timestamp, through Push or Update, have the zero time.
+func (a *Anomalyzer) Timestamps() []time.Time {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	times := make([]time.Time, len(a.Data))
+	copy(times, a.alignedTimes())
+	return times
+}
+
+// Return the timestamps lined up with Data.  They can fall out of step if
+// Data is changed directly, in which case the newest timestamps are matched
+// to the newest points and any points left over have no timestamp.
+func (a *Anomalyzer) alignedTimes() []time.Time {
+	n := len(a.Data)
+	if len(a.times) == n {
+		return a.times
+	}
+
+	times := make([]time.Time, n)
+	if len(a.times) > n {
+		copy(times, a.times[len(a.times)-n:])
+	} else {
+		copy(times[n-len(a.times):], a.times)
+	}
+	return times
+}
+
+// Return the time to stamp a point added without a timestamp with: the
+// current time when Conf.Interval is set, so that it lands in the bucket it
+// arrived in, and otherwise the zero time.
+func (a *Anomalyzer) now() time.Time {
+	if a.Conf.Interval <= 0 {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// Return the index of the first of the points with the given timestamps to
+// retain so that at most size of them remain or, when Conf.Interval is set,
+// so that they resample to at most size buckets.  In the latter case the
+// bucket before those is kept as well, since its value is carried forward
+// into any empty buckets that follow it.
+func (a *Anomalyzer) retainFrom(times []time.Time, size int) int {
+	interval := a.Conf.Interval
+	if interval <= 0 || len(times) == 0 {
+		return max(0, len(times)-size)
+	}
+
+	latest := times[0]
+	for _, t := range times {
+		if t.After(latest) {
+			latest = t
+		}
+	}
+	cutoff := latest.Truncate(interval).Add(-time.Duration(size-1) * interval)
+
+	// timestamps that go backwards are clamped, as they are by resample
+	last := times[0]
+	bucket, previous := 0, 0
+	for i, t := range times {
+		if t.Before(last) {
+			t = last
+		}
+		if !t.Truncate(interval).Equal(last.Truncate(interval)) {
+			bucket, previous = i, bucket
+		}
+		last = t
+		if !t.Before(cutoff) {
+			return previous
+		}
+	}
+	return previous
+}
+
+// Return the series the tests are run over, which is Data resampled to
+// Conf.Interval when one is set, with its reference window drawn from the
+// previous seasons when Conf.SeasonalReference is set and there is enough
+// data to do so.
+func (a *Anomalyzer) series() govector.Vector {
+	series := a.sampled()
+	if a.Conf.SeasonalReference && len(series) >= a.Conf.minDataPoints() {
+		series = seasonalSeries(series, a.Conf)
+	}
+	return series
+}
+
+// Return Data resampled to Conf.Interval when one is set.
+func (a *Anomalyzer) sampled() govector.Vector {
+	if a.Conf.Interval <= 0 {
+		return a.Data
+	}
+	return resample(a.Data, a.alignedTimes(), a.Conf.Interval, a.Conf.seriesSize())
+}
+
+// Average the values into consecutive buckets of the given interval,
+// carrying the previous bucket forward into any empty ones, and return at
+// most the last size buckets.  Timestamps that go backwards are clamped to
+// the latest timestamp seen so far.
+func resample(values govector.Vector, times []time.Time, interval time.Duration, size int) govector.Vector {
+	if len(values) == 0 {
+		return values
+	}
+
+	resampled := govector.Vector{}
+	last := times[0]
+	bucket := last.Truncate(interval)
+	prev, sum, count := values[0], 0.0, 0
+
+	for i, x := range values {
+		t := times[i]
+		if t.Before(last) {
+			t = last
+		}
+		last = t
+
+		// close out every bucket that ends before this point
+		for !t.Before(bucket.Add(interval)) {
+			if count > 0 {
+				prev = sum / float64(count)
+			}
+			resampled = append(resampled, prev)
+			sum, count = 0, 0
+			bucket = bucket.Add(interval)
+
+			// skip over long gaps rather than fill them, since only
+			// the last size buckets are kept anyway
+			if gaps := int(t.Sub(bucket) / interval); gaps > size {
+				bucket = bucket.Add(time.Duration(gaps-size) * interval)
+			}
+		}
+
+		sum += x
+		count++
+	}
+	resampled = append(resampled, sum/float64(count))
+
+	return truncate(resampled, size)
+}
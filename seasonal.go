@@ -0,0 +1,21 @@
+package anomalyzer
+
+import (
+	"github.com/drewlanenga/govector"
+)
+
+// Assemble the series the tests are run over when the reference window is
+// phase-aligned: the slice at the same phase as the active window from each
+// of the previous NSeasons seasons, oldest first, followed by the active
+// window itself.  The windows extracted from the result are then the
+// seasonal reference window and the active window.  The series must hold
+// at least minDataPoints points.
+func seasonalSeries(series govector.Vector, conf *AnomalyzerConf) govector.Vector {
+	n := len(series)
+	assembled := make(govector.Vector, 0, conf.referenceSize+conf.ActiveSize)
+	for season := conf.NSeasons; season > 0; season-- {
+		end := n - season*conf.SeasonLength
+		assembled = append(assembled, series[end-conf.ActiveSize:end]...)
+	}
+	return append(assembled, series[n-conf.ActiveSize:]...)
+}
@@ -0,0 +1,130 @@
+package anomalyzer
+
+import (
+	"math"
+
+	"github.com/drewlanenga/govector"
+)
+
+// A running mean and variance, maintained with Welford's method as values
+// are added to and removed from a window.  Removing values leaves rounding
+// residue behind, so the number of most recently added values that are
+// all equal is tracked too, and once it covers the whole window, as with a
+// run of zeros, the mean and variance are set exactly.  Otherwise a mean of
+// zero would come out as a tiny residue, which the magnitude test treats
+// very differently.
+type runningStats struct {
+	n    int
+	mean float64
+	m2   float64
+
+	last float64
+	run  int
+}
+
+func (s *runningStats) add(x float64) {
+	if s.n > 0 && x == s.last {
+		s.run++
+	} else {
+		s.run = 1
+	}
+	s.last = x
+
+	s.n++
+	delta := x - s.mean
+	s.mean += delta / float64(s.n)
+	s.m2 += delta * (x - s.mean)
+	s.snap()
+}
+
+func (s *runningStats) remove(x float64) {
+	if s.n <= 1 {
+		*s = runningStats{}
+		return
+	}
+	s.n--
+	s.run = min(s.run, s.n)
+	delta := x - s.mean
+	s.mean -= delta / float64(s.n)
+	s.m2 -= delta * (x - s.mean)
+	if s.m2 < 0 {
+		s.m2 = 0
+	}
+	s.snap()
+}
+
+// Set the mean and variance exactly if every value in the window is the
+// same.
+func (s *runningStats) snap() {
+	if s.run == s.n {
+		s.mean, s.m2 = s.last, 0
+	}
+}
+
+// Return the sample standard deviation, as govector's Sd does.
+func (s *runningStats) sd() float64 {
+	return math.Sqrt(s.m2 / float64(s.n-1))
+}
+
+func (s *runningStats) reset(vector govector.Vector) {
+	*s = runningStats{}
+	for _, x := range vector {
+		s.add(x)
+	}
+}
+
+// The running statistics of the active and reference windows, so that
+// pushing a point updates them in constant time rather than the tests
+// recomputing them over the whole windows.
+type windowStats struct {
+	active, reference runningStats
+
+	// whether the statistics are up to date, the length of the data they
+	// were computed for, and the number of updates since they were last
+	// computed from scratch
+	valid   bool
+	length  int
+	updates int
+}
+
+// Update the statistics for x being pushed onto data, before it is added.
+// The statistics are recomputed from scratch, by the next call to sync,
+// whenever data is not the length they were computed for, and after every
+// window's worth of updates to bound the rounding error that accumulates.
+func (s *windowStats) push(data govector.Vector, x float64, conf *AnomalyzerConf) {
+	n := len(data)
+	if !s.valid || n != s.length || s.updates >= conf.minDataPoints() {
+		s.valid = false
+		return
+	}
+
+	// the oldest point of the active window moves into the reference
+	// window, and the oldest point of the reference window leaves it
+	if n >= conf.ActiveSize {
+		moved := data[n-conf.ActiveSize]
+		s.active.remove(moved)
+		s.reference.add(moved)
+	}
+	if n >= conf.minDataPoints() {
+		s.reference.remove(data[n-conf.minDataPoints()])
+	}
+	s.active.add(x)
+
+	s.length = n + 1
+	if size := conf.maxDataPoints(); size > 0 {
+		s.length = min(s.length, size)
+	}
+	s.updates++
+}
+
+// Recompute the statistics from the windows if they are not up to date.
+func (s *windowStats) sync(data govector.Vector, conf *AnomalyzerConf) {
+	if s.valid && len(data) == s.length {
+		return
+	}
+
+	reference, active, _ := extractWindows(data, conf.referenceSize, conf.ActiveSize, -1)
+	s.active.reset(active)
+	s.reference.reset(reference)
+	s.valid, s.length, s.updates = true, len(data), 0
+}